@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/openshift/content-mirror/pkg/config"
+)
+
+// frontends returns the servers nginx listens on. Unless --listen is empty
+// the default frontend serves every upstream over HTTP, or redirects to HTTPS.
+// If a certificate is set the default HTTPS frontend serves every upstream
+// over HTTPS. Each --frontend adds a server for a subset of the upstreams.
+func (opt *Options) frontends(nginx config.NginxFeatures) ([]config.Frontend, error) {
+	hasCertificate := len(opt.TLSCertificate) > 0 || len(opt.TLSKey) > 0
+	if hasCertificate {
+		if len(opt.TLSCertificate) == 0 || len(opt.TLSKey) == 0 {
+			return nil, fmt.Errorf("--tls-certificate and --tls-key must be set together")
+		}
+		if !nginx.HasModule("http_ssl_module") {
+			return nil, fmt.Errorf("nginx does not include http_ssl_module and cannot serve HTTPS")
+		}
+	} else if opt.RedirectHTTP {
+		return nil, fmt.Errorf("--redirect-http requires --tls-certificate and --tls-key")
+	}
+	if strings.ContainsAny(opt.TLSCiphers, " ;'\"{}") {
+		return nil, fmt.Errorf("--tls-ciphers must be a list of ciphers separated by ':'")
+	}
+	var protocols []string
+	for _, protocol := range opt.TLSProtocols {
+		switch protocol {
+		case "TLSv1", "TLSv1.1", "TLSv1.2":
+		case "TLSv1.3":
+			if !nginx.AtLeast("1.13.0") {
+				log.Printf("warn: nginx %s does not support TLSv1.3, it will not be enabled", nginx.Version)
+				continue
+			}
+		default:
+			return nil, fmt.Errorf("--tls-protocols must be TLSv1, TLSv1.1, TLSv1.2 or TLSv1.3")
+		}
+		protocols = append(protocols, protocol)
+	}
+	// serveTLS configures a frontend to serve HTTPS with the certificate
+	serveTLS := func(frontend *config.Frontend) {
+		frontend.CertificatePath = opt.TLSCertificate
+		frontend.KeyPath = opt.TLSKey
+		frontend.Protocols = protocols
+		frontend.Ciphers = opt.TLSCiphers
+	}
+
+	var frontends []config.Frontend
+	if len(opt.Listen) > 0 {
+		frontend := config.Frontend{Name: "default", Listen: opt.Listen}
+		if opt.RedirectHTTP {
+			frontend.HTTPSRedirectPort = listenPort(opt.TLSListen)
+		}
+		frontends = append(frontends, frontend)
+	}
+	if hasCertificate && len(opt.TLSListen) > 0 {
+		frontend := config.Frontend{Name: "default-https", Listen: opt.TLSListen}
+		serveTLS(&frontend)
+		frontends = append(frontends, frontend)
+	}
+	for _, s := range opt.Frontends {
+		frontend, tls, err := parseFrontend(s)
+		if err != nil {
+			return nil, fmt.Errorf("--frontend %q: %v", s, err)
+		}
+		if tls {
+			if !hasCertificate {
+				return nil, fmt.Errorf("--frontend %q: tls requires --tls-certificate and --tls-key", s)
+			}
+			serveTLS(&frontend)
+		}
+		frontends = append(frontends, frontend)
+	}
+
+	if len(frontends) == 0 {
+		return nil, fmt.Errorf("no frontends are configured, set --listen, --tls-listen or --frontend")
+	}
+	names := make(map[string]struct{})
+	for _, frontend := range frontends {
+		if err := frontend.Validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := names[frontend.Name]; ok {
+			return nil, fmt.Errorf("the frontend name %s is used more than once", frontend.Name)
+		}
+		names[frontend.Name] = struct{}{}
+	}
+	return frontends, nil
+}
+
+// parseFrontend parses a frontend of the form
+//
+//	NAME ADDRESS [server_name=HOST,...] [upstreams=SELECTOR,...] [tls]
+//
+// and returns whether it serves HTTPS.
+func parseFrontend(s string) (config.Frontend, bool, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return config.Frontend{}, false, fmt.Errorf("a frontend requires a name and an address")
+	}
+	frontend := config.Frontend{Name: fields[0], Listen: fields[1]}
+	var tls bool
+	for _, field := range fields[2:] {
+		parts := strings.SplitN(field, "=", 2)
+		switch {
+		case field == "tls":
+			tls = true
+		case len(parts) != 2:
+			return config.Frontend{}, false, fmt.Errorf("unrecognized frontend option %q", field)
+		case parts[0] == "server_name":
+			frontend.ServerNames = append(frontend.ServerNames, strings.Split(parts[1], ",")...)
+		case parts[0] == "upstreams":
+			frontend.Upstreams = append(frontend.Upstreams, strings.Split(parts[1], ",")...)
+		default:
+			return config.Frontend{}, false, fmt.Errorf("unrecognized frontend option %q", field)
+		}
+	}
+	return frontend, tls, nil
+}
+
+// certificateDirs returns the directories that contain the certificate and
+// key. They are watched so that nginx loads the files again when they are
+// replaced.
+func (opt *Options) certificateDirs() ([]string, error) {
+	var dirs []string
+	for _, path := range []string{opt.TLSCertificate, opt.TLSKey} {
+		if len(path) == 0 {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+		dir := filepath.Dir(path)
+		if len(dirs) > 0 && dirs[0] == dir {
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+// listenPort returns the port of an nginx listen address, which is a port,
+// host:port, or a host on port 80.
+func listenPort(listen string) string {
+	if i := strings.LastIndex(listen, ":"); i != -1 && !strings.HasSuffix(listen, "]") {
+		return listen[i+1:]
+	}
+	if _, err := strconv.Atoi(listen); err == nil {
+		return listen
+	}
+	return "80"
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	htmltemplate "html/template"
 	"log"
 	"mime"
 	"net/http"
+	"net/url"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/openshift/content-mirror/pkg/config"
+	"github.com/openshift/content-mirror/pkg/health"
+	"github.com/openshift/content-mirror/pkg/process"
 )
 
 const templateHTMLIndex = `
@@ -23,17 +28,45 @@ const templateHTMLIndex = `
       <h1>Available content</h1>
     <ul>
       {{- range .Upstreams }}
-      {{- if .Repo }}
+      {{- if and .Repo (eq .Type "rpm") }}
       <li><a href="/{{ .Name }}">{{ .Name }}</a> (<a href="/{{ .Name }}.repo">RPM repo</a>)
+      {{- else if and .Repo (eq .Type "pypi") }}
+      <li><a href="/{{ .Name }}">{{ .Name }}</a> (<a href="/{{ .Name }}.pip.conf">pip.conf</a>)
+      {{- else if and .Repo (eq .Type "goproxy") }}
+      <li><a href="/{{ .Name }}">{{ .Name }}</a> (<a href="/{{ .Name }}.goenv">Go proxy</a>: <code>GOPROXY={{ .URL }}</code>)
+      {{- else if and .Repo (eq .Type "npm") }}
+      <li><a href="/{{ .Name }}">{{ .Name }}</a> (<a href="/{{ .Name }}.npmrc">.npmrc</a>)
+      {{- else if and .Repo (eq .Type "maven") }}
+      <li><a href="/{{ .Name }}">{{ .Name }}</a> (<a href="/{{ .Name }}.settings.xml">Maven settings.xml</a>)
+      {{- else if and .Repo (eq .Type "helm") }}
+      <li><a href="/{{ .Name }}">{{ .Name }}</a> (Helm repository: <code>helm repo add {{ .Name }} {{ .URL }}</code>)
+      {{- else if and .Repo (eq .Type "apk") }}
+      <li><a href="/{{ .Name }}">{{ .Name }}</a> (<a href="/{{ .Name }}.repositories">APK repository</a>)
+      {{- else if and .Repo (eq .Type "registry") }}
+      <li>{{ .Name }} (container registry mirror: <code>{{ location .URL }}</code>)
+      {{- else if and .Repo (eq .Type "apt") }}
+      <li><a href="/{{ .Name }}">{{ .Name }}</a> (<a href="/{{ .Name }}.list">APT sources.list</a>, <a href="/{{ .Name }}.sources">deb822</a>)
       {{- else }}
       <li><a href="/{{ .Name }}">{{ .Name }}</a>
       {{- end }}
+      {{- if .HealthPath }}
+        <ul>
+        {{- range .Origins }}
+          <li>{{ .Origin }}: {{ health .Origin }}</li>
+        {{- end }}
+        </ul>
+      {{- end }}
       {{- end }}
     </ul>
+    {{- if .HasUpstreamType "apk" }}
+    <p><a href="/repositories">/etc/apk/repositories</a> for all Alpine repositories</p>
+    {{- end }}
   </body>
 </html>
 `
 
+// templateUpstreamRepository is served to clients and must never include the
+// credentials used to reach the upstream.
 const templateUpstreamRepository = `
 [{{ .Name }}]
 id = {{ .Name }}
@@ -43,14 +76,154 @@ enabled = 1
 gpgcheck = 0
 `
 
-// ConfigAccessor returns the last valid configuration.
+// templateUpstreamAPTList is a sources.list snippet served to clients.
+const templateUpstreamAPTList = `
+{{- $url := .URL }}
+{{- range .APT }}
+{{- $entry := . }}
+{{- range .Types }}
+{{- $type := . }}
+{{- range $entry.Suites }}
+{{ $type }} {{ with $entry.ListOptions }}[ {{ . }} ] {{ end }}{{ $url }} {{ . }}{{ range $entry.Components }} {{ . }}{{ end }}
+{{- end }}
+{{- end }}
+{{- end }}
+`
+
+// templateUpstreamAPTSources is a deb822 sources snippet served to clients.
+const templateUpstreamAPTSources = `
+{{- $url := .URL }}
+{{- range $i, $entry := .APT }}
+{{- if $i }}
+{{ end }}
+Types: {{ join .Types " " }}
+URIs: {{ $url }}
+Suites: {{ join .Suites " " }}
+{{- if .Components }}
+Components: {{ join .Components " " }}
+{{- end }}
+{{- range .Options }}
+{{ .Field }}:{{ .Deb822Value }}
+{{- end }}
+{{- end }}
+`
+
+// templateUpstreamPipConfig is a pip.conf snippet served to clients.
+const templateUpstreamPipConfig = `
+[global]
+index-url = {{ .URL }}/
+{{- if eq (scheme .URL) "http" }}
+trusted-host = {{ host .URL }}
+{{- end }}
+`
+
+// templateUpstreamNPMConfig is an .npmrc snippet served to clients.
+const templateUpstreamNPMConfig = `
+registry={{ .URL }}/
+`
+
+// templateUpstreamMavenSettings is a Maven settings.xml that mirrors Maven
+// Central, served to clients.
+const templateUpstreamMavenSettings = `
+<settings>
+  <mirrors>
+    <mirror>
+      <id>{{ .Name }}</id>
+      <name>{{ .Name }}</name>
+      <mirrorOf>central</mirrorOf>
+      <url>{{ .URL }}/</url>
+    </mirror>
+  </mirrors>
+</settings>
+`
+
+// templateUpstreamAPKRepository is a line of an Alpine repositories file
+// served to clients.
+const templateUpstreamAPKRepository = `
+{{- with .APKTag }}@{{ . }} {{ end }}{{ .URL }}/
+`
+
+// templateUpstreamGoEnv sets the Go module proxy, in the format read by
+// go env -w and shells.
+const templateUpstreamGoEnv = `
+GOPROXY={{ .URL }}
+`
+
+// templateUpstreamGoProxyComment lists a Go module proxy alongside the
+// repositories in the plain text index, which must remain a valid yum
+// repository file.
+const templateUpstreamGoProxyComment = `
+# Go proxy {{ .Name }}
+# GOPROXY={{ .URL }}
+`
+
+// ConfigAccessor returns the last valid configuration, why the most recently
+// generated configuration was rejected, if it was, and the inputs that were
+// ignored when it was loaded.
 type ConfigAccessor interface {
 	LastConfig() *config.CacheConfig
+	LastError() *config.ValidationError
+	Rejected() []config.RejectedInput
+	Renamed() []config.RenamedUpstream
+}
+
+// status is served as JSON from /status.
+type status struct {
+	// Upstreams is the number of upstreams that are live.
+	Upstreams int `json:"upstreams"`
+	// Error is set if the most recently generated configuration was
+	// rejected.
+	Error string `json:"error,omitempty"`
+	// Rejected lists the inputs that were ignored.
+	Rejected []rejectedInput `json:"rejected"`
+	// Renamed lists the upstreams whose names were not safe to use.
+	Renamed []renamedUpstream `json:"renamed"`
+	// Restarts lists the most recent unexpected exits of nginx.
+	Restarts []restart `json:"restarts"`
+}
+
+type restart struct {
+	Time    time.Time `json:"time"`
+	Uptime  string    `json:"uptime"`
+	Error   string    `json:"error,omitempty"`
+	Output  []string  `json:"output,omitempty"`
+	Backoff string    `json:"backoff"`
+}
+
+type renamedUpstream struct {
+	Path string `json:"path"`
+	Name string `json:"name"`
+	To   string `json:"to"`
 }
 
-// NewHandlers returns the HTTP handlers for the provided config.
-func NewHandlers(config ConfigAccessor) (http.Handler, error) {
-	indexTemplate, err := htmltemplate.New("index").Parse(templateHTMLIndex)
+type rejectedInput struct {
+	Path    string `json:"path"`
+	Section string `json:"section,omitempty"`
+	Error   string `json:"error"`
+}
+
+// HealthAccessor reports the health of an upstream origin.
+type HealthAccessor interface {
+	Status(origin string) health.Status
+}
+
+// RestartAccessor reports the unexpected exits of nginx.
+type RestartAccessor interface {
+	Restarts() []process.Restart
+}
+
+// NewHandlers returns the HTTP handlers for the provided config. Requests
+// nginx makes on behalf of registry and Helm upstreams are served by
+// registries and charts.
+func NewHandlers(accessor ConfigAccessor, health HealthAccessor, restarts RestartAccessor, registries, charts http.Handler) (http.Handler, error) {
+	indexTemplate, err := htmltemplate.New("index").Funcs(htmltemplate.FuncMap{
+		"health": func(origin string) string { return health.Status(origin).String() },
+		// the location of a registry mirror has no scheme
+		"location": func(s string) string {
+			u, _ := url.Parse(s)
+			return u.Host + u.Path
+		},
+	}).Parse(templateHTMLIndex)
 	if err != nil {
 		return nil, err
 	}
@@ -58,33 +231,167 @@ func NewHandlers(config ConfigAccessor) (http.Handler, error) {
 	if err != nil {
 		return nil, err
 	}
+	funcs := template.FuncMap{
+		"join": strings.Join,
+		"scheme": func(s string) string {
+			u, _ := url.Parse(s)
+			return u.Scheme
+		},
+		"host": func(s string) string {
+			u, _ := url.Parse(s)
+			return u.Hostname()
+		},
+	}
+	aptList, err := template.New("apt-list").Funcs(funcs).Parse(templateUpstreamAPTList)
+	if err != nil {
+		return nil, err
+	}
+	aptSources, err := template.New("apt-sources").Funcs(funcs).Parse(templateUpstreamAPTSources)
+	if err != nil {
+		return nil, err
+	}
+	pipConfig, err := template.New("pip-config").Funcs(funcs).Parse(templateUpstreamPipConfig)
+	if err != nil {
+		return nil, err
+	}
+	npmConfig, err := template.New("npm-config").Parse(templateUpstreamNPMConfig)
+	if err != nil {
+		return nil, err
+	}
+	mavenSettings, err := template.New("maven-settings").Parse(templateUpstreamMavenSettings)
+	if err != nil {
+		return nil, err
+	}
+	apkRepository, err := template.New("apk-repository").Parse(templateUpstreamAPKRepository)
+	if err != nil {
+		return nil, err
+	}
+	goEnv, err := template.New("go-env").Parse(templateUpstreamGoEnv)
+	if err != nil {
+		return nil, err
+	}
+	goProxyComment, err := template.New("go-proxy-comment").Parse(templateUpstreamGoProxyComment)
+	if err != nil {
+		return nil, err
+	}
+
+	// clientConfigs are the files clients can use to consume an upstream,
+	// by suffix. Upstream names that end in a suffix are rejected when the
+	// configuration is loaded, so a new suffix must also be added there.
+	clientConfigs := map[string]struct {
+		upstreamType config.UpstreamType
+		template     *template.Template
+	}{
+		".repo":         {config.UpstreamTypeRPM, upstreamRepo},
+		".list":         {config.UpstreamTypeAPT, aptList},
+		".sources":      {config.UpstreamTypeAPT, aptSources},
+		".pip.conf":     {config.UpstreamTypePyPI, pipConfig},
+		".npmrc":        {config.UpstreamTypeNPM, npmConfig},
+		".goenv":        {config.UpstreamTypeGoProxy, goEnv},
+		".settings.xml": {config.UpstreamTypeMaven, mavenSettings},
+		".repositories": {config.UpstreamTypeAPK, apkRepository},
+	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/healthz", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lastErr := accessor.LastError()
+		if accessor.LastConfig() == nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			if lastErr != nil {
+				fmt.Fprintf(w, "error: no configuration is live: %v\n", lastErr)
+				return
+			}
+			fmt.Fprintln(w, "error: no configuration is live")
+			return
+		}
+		// the mirror still serves the last valid configuration
+		if lastErr != nil {
+			fmt.Fprintf(w, "warning: the configuration generated at %s was rejected, the last valid configuration is in use: %v\n", lastErr.Time.Format(time.RFC3339), lastErr)
+			return
+		}
 		fmt.Fprintln(w, "ok")
 	}))
+	mux.Handle("/status", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		current := status{Rejected: []rejectedInput{}, Renamed: []renamedUpstream{}, Restarts: []restart{}}
+		if lastConfig := accessor.LastConfig(); lastConfig != nil {
+			current.Upstreams = len(lastConfig.Upstreams)
+		}
+		if lastErr := accessor.LastError(); lastErr != nil {
+			current.Error = lastErr.Error()
+		}
+		for _, rejected := range accessor.Rejected() {
+			current.Rejected = append(current.Rejected, rejectedInput{
+				Path:    rejected.Path,
+				Section: rejected.Section,
+				Error:   rejected.Err.Error(),
+			})
+		}
+		for _, renamed := range accessor.Renamed() {
+			current.Renamed = append(current.Renamed, renamedUpstream{Path: renamed.Path, Name: renamed.Name, To: renamed.To})
+		}
+		for _, r := range restarts.Restarts() {
+			item := restart{Time: r.Time, Uptime: r.Uptime.String(), Output: r.Output, Backoff: r.Backoff.String()}
+			if r.Err != nil {
+				item.Error = r.Err.Error()
+			}
+			current.Restarts = append(current.Restarts, item)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(current)
+	}))
+	mux.Handle("/_registry/", registries)
+	mux.Handle("/_helm/", charts)
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		lastConfig := config.LastConfig()
-		if strings.Count(req.URL.Path, "/") == 1 && strings.HasSuffix(req.URL.Path, ".repo") {
-			name := strings.TrimSuffix(req.URL.Path[1:], ".repo")
+		lastConfig := accessor.LastConfig()
+		if lastConfig == nil {
+			http.Error(w, "no configuration is live", http.StatusServiceUnavailable)
+			return
+		}
+		// only show the upstreams the frontend the request was received by
+		// serves
+		if frontend, ok := lastConfig.Frontend(req.Header.Get(config.FrontendHeader)); ok {
+			exposed := lastConfig.Exposed(frontend)
+			lastConfig = &exposed
+		}
+		for suffix, clientConfig := range clientConfigs {
+			if strings.Count(req.URL.Path, "/") != 1 || !strings.HasSuffix(req.URL.Path, suffix) {
+				continue
+			}
+			name := strings.TrimSuffix(req.URL.Path[1:], suffix)
 			for _, upstream := range lastConfig.Upstreams {
 				if upstream.Name != name {
 					continue
 				}
-				// not a candidate for being an RPM repository
-				if !upstream.Repo {
+				// not a candidate for this kind of client configuration
+				if !upstream.Repo || upstream.Type != clientConfig.upstreamType {
 					break
 				}
 
-				// output an RPM repository file dynamically
+				// output a client configuration file dynamically
 				upstream.URL = urlForRepo(req, &upstream)
 
-				if err := upstreamRepo.Execute(w, &upstream); err != nil {
+				if err := clientConfig.template.Execute(w, &upstream); err != nil {
 					log.Printf("error: Unable to write repository template %v", err)
 				}
 				return
 			}
 		}
+		if req.URL.Path == "/repositories" {
+			// an /etc/apk/repositories file listing every Alpine repository
+			for _, upstream := range lastConfig.Upstreams {
+				if !upstream.Repo || upstream.Type != config.UpstreamTypeAPK {
+					continue
+				}
+				upstream.URL = urlForRepo(req, &upstream)
+				if err := apkRepository.Execute(w, &upstream); err != nil {
+					log.Printf("error: Unable to write repository template %v", err)
+					break
+				}
+			}
+			return
+		}
 		if req.URL.Path != "/" {
 			http.NotFound(w, req)
 			return
@@ -92,7 +399,14 @@ func NewHandlers(config ConfigAccessor) (http.Handler, error) {
 
 		match, _ := hasAccept(req.Header.Get("Accept"), "text/html", "text/plain")
 		if match == "text/html" {
-			if err := indexTemplate.Execute(w, lastConfig); err != nil {
+			// show the URLs clients use to reach each upstream
+			index := *lastConfig
+			index.Upstreams = make([]config.Upstream, 0, len(lastConfig.Upstreams))
+			for _, upstream := range lastConfig.Upstreams {
+				upstream.URL = urlForRepo(req, &upstream)
+				index.Upstreams = append(index.Upstreams, upstream)
+			}
+			if err := indexTemplate.Execute(w, &index); err != nil {
 				log.Printf("error: Unable to write index template %v", err)
 			}
 			return
@@ -101,8 +415,17 @@ func NewHandlers(config ConfigAccessor) (http.Handler, error) {
 			if !upstream.Repo {
 				continue
 			}
+			var listing *template.Template
+			switch upstream.Type {
+			case config.UpstreamTypeRPM:
+				listing = upstreamRepo
+			case config.UpstreamTypeGoProxy:
+				listing = goProxyComment
+			default:
+				continue
+			}
 			upstream.URL = urlForRepo(req, &upstream)
-			if err := upstreamRepo.Execute(w, &upstream); err != nil {
+			if err := listing.Execute(w, &upstream); err != nil {
 				log.Printf("error: Unable to write index template %v", err)
 				break
 			}
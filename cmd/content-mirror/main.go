@@ -1,17 +1,25 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"text/template"
 	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/openshift/content-mirror/pkg/config"
+	"github.com/openshift/content-mirror/pkg/health"
+	"github.com/openshift/content-mirror/pkg/helm"
 	"github.com/openshift/content-mirror/pkg/process"
+	"github.com/openshift/content-mirror/pkg/registry"
+	"github.com/openshift/content-mirror/pkg/tunnel"
 	"github.com/openshift/content-mirror/pkg/watcher"
 )
 
@@ -23,12 +31,30 @@ func main() {
 		CacheTimeout: "15m",
 		Listen:       "8080",
 
-		LocalPort: 9001,
+		TLSListen:    "8443",
+		TLSProtocols: []string{"TLSv1.2", "TLSv1.3"},
+
+		VerifyUpstreams: true,
+		VariableDirs:    []string{"/etc/dnf/vars", "/etc/yum/vars"},
+		MirrorRefresh:   time.Hour,
+		HealthInterval:  time.Minute,
+		TunnelDir:       "/tmp/content-mirror-tunnels",
+
+		NginxBinary: "nginx",
+		RuntimeDir:  "/tmp/content-mirror-nginx",
+
+		LocalPort:       9001,
+		ShutdownTimeout: 25 * time.Second,
+
+		MaxRestarts:       process.DefaultRestartPolicy.MaxRestarts,
+		RestartWindow:     process.DefaultRestartPolicy.Window,
+		MaxRestartBackoff: process.DefaultRestartPolicy.MaxBackoff,
 	}
 	cmd := &cobra.Command{
 		Short: "Proxy RPM repositories and other important content",
 
 		SilenceUsage: true,
+		Args:         cobra.ArbitraryArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) > 0 {
 				opt.Paths = args
@@ -36,13 +62,36 @@ func main() {
 			return opt.Run()
 		},
 	}
+	cmd.AddCommand(NewValidateCommand(opt), NewRenderCommand(opt))
 
 	cmd.Flags().StringVar(&opt.ConfigPath, "path", opt.ConfigPath, "The path to write the configuration to.")
-	cmd.Flags().StringVar(&opt.CacheDir, "cache-dir", opt.CacheDir, "The directory to cache mirrored content into.")
-	cmd.Flags().StringVar(&opt.MaxCacheSize, "max-size", opt.MaxCacheSize, "The maximum size of the cache (e.g. 10g, 100m).")
-	cmd.Flags().StringVar(&opt.CacheTimeout, "timeout", opt.CacheTimeout, "How long an item is kept in the cache.")
-	cmd.Flags().StringVar(&opt.Listen, "listen", opt.Listen, "The address (host:port, host, or port) to bind to for serving content.")
-	cmd.Flags().BoolVarP(&opt.Verbose, "verbose", "v", opt.Verbose, "Display verbose output from the local server and nginx.")
+	cmd.PersistentFlags().StringVar(&opt.CacheDir, "cache-dir", opt.CacheDir, "The directory to cache mirrored content into.")
+	cmd.PersistentFlags().StringVar(&opt.MaxCacheSize, "max-size", opt.MaxCacheSize, "The maximum size of the cache (e.g. 10g, 100m).")
+	cmd.PersistentFlags().StringVar(&opt.CacheTimeout, "timeout", opt.CacheTimeout, "How long an item is kept in the cache.")
+	cmd.PersistentFlags().StringArrayVar(&opt.CacheRules, "cache-rule", opt.CacheRules, "A cache rule applied to every upstream, in the form 'PATTERN [ttl=TIME] [negative=TIME] [stale=COND,...] [nocache] [vary=accept]' where PATTERN matches the path relative to the upstream. Rules are applied in order after the rules of the upstream and before the built-in rules of its type.")
+	cmd.PersistentFlags().StringVar(&opt.UpstreamCABundle, "upstream-ca-bundle", opt.UpstreamCABundle, fmt.Sprintf("The CA bundle used to verify upstream servers that do not set sslcacert. Defaults to the first of %s that exists.", strings.Join(caBundlePaths, ", ")))
+	cmd.PersistentFlags().BoolVar(&opt.VerifyUpstreams, "verify-upstream-tls", opt.VerifyUpstreams, "Verify https upstreams that do not use client certificates. Repositories may still disable verification with sslverify=0.")
+	cmd.PersistentFlags().StringArrayVar(&opt.Variables, "var", opt.Variables, "Set a repository variable (name=value) such as releasever=7. Overrides all other sources.")
+	cmd.PersistentFlags().StringSliceVar(&opt.VariableDirs, "vars-dir", opt.VariableDirs, "Directories containing one file per repository variable. Earlier directories take precedence.")
+	cmd.PersistentFlags().StringSliceVar(&opt.Architectures, "arch", opt.Architectures, "If set, repositories that use $basearch are mirrored once per architecture as <id>-<arch>.")
+	cmd.Flags().DurationVar(&opt.MirrorRefresh, "mirror-refresh-interval", opt.MirrorRefresh, "How often mirrorlist and metalink URLs are retrieved again. Zero disables refreshing.")
+	cmd.Flags().DurationVar(&opt.ShutdownTimeout, "shutdown-timeout", opt.ShutdownTimeout, "How long nginx may take to finish serving requests after SIGTERM or SIGINT before it is killed.")
+	cmd.Flags().IntVar(&opt.MaxRestarts, "max-restarts", opt.MaxRestarts, "How many times nginx may exit within --restart-window before the mirror exits.")
+	cmd.Flags().DurationVar(&opt.RestartWindow, "restart-window", opt.RestartWindow, "How long an nginx exit counts against --max-restarts.")
+	cmd.Flags().DurationVar(&opt.MaxRestartBackoff, "max-restart-backoff", opt.MaxRestartBackoff, "The longest delay before nginx is restarted. The delay starts at one second and doubles for each exit within --restart-window.")
+	cmd.Flags().DurationVar(&opt.HealthInterval, "health-check-interval", opt.HealthInterval, "How often the origins of each repository are checked. Zero disables checking.")
+	cmd.PersistentFlags().StringVar(&opt.TunnelDir, "tunnel-dir", opt.TunnelDir, "The directory to create sockets in for upstreams reached through a proxy.")
+	cmd.PersistentFlags().StringVar(&opt.Listen, "listen", opt.Listen, "The address (host:port, host, or port) to bind to for serving content.")
+	cmd.PersistentFlags().StringVar(&opt.TLSCertificate, "tls-certificate", opt.TLSCertificate, "A PEM encoded certificate to serve content over HTTPS with. The certificate and key are loaded again whenever they change.")
+	cmd.PersistentFlags().StringVar(&opt.TLSKey, "tls-key", opt.TLSKey, "The PEM encoded private key of --tls-certificate.")
+	cmd.PersistentFlags().StringVar(&opt.TLSListen, "tls-listen", opt.TLSListen, "The address (host:port, host, or port) to bind to for serving content over HTTPS.")
+	cmd.PersistentFlags().StringSliceVar(&opt.TLSProtocols, "tls-protocols", opt.TLSProtocols, "The TLS versions accepted over HTTPS.")
+	cmd.PersistentFlags().StringVar(&opt.TLSCiphers, "tls-ciphers", opt.TLSCiphers, "The ciphers accepted over HTTPS, in the OpenSSL format such as HIGH:!aNULL:!MD5. If empty the nginx default is used.")
+	cmd.PersistentFlags().BoolVar(&opt.RedirectHTTP, "redirect-http", opt.RedirectHTTP, "Redirect requests to --listen to HTTPS instead of serving content. If --listen is empty content is only served over HTTPS.")
+	cmd.PersistentFlags().StringArrayVar(&opt.Frontends, "frontend", opt.Frontends, "An additional server, in the form 'NAME ADDRESS [server_name=HOST,...] [upstreams=SELECTOR,...] [tls]', that serves the upstreams matching any SELECTOR. A SELECTOR is an upstream name, a glob such as rhel-*, or a label such as team=partner. If upstreams is omitted every upstream is served, and tls serves HTTPS with --tls-certificate.")
+	cmd.PersistentFlags().StringVar(&opt.NginxBinary, "nginx-binary", opt.NginxBinary, "The nginx binary to run, or a name to look up in the PATH.")
+	cmd.PersistentFlags().StringVar(&opt.RuntimeDir, "nginx-runtime-dir", opt.RuntimeDir, "The directory nginx keeps its pid file, temporary files and access log in. If empty the paths nginx was built with are used.")
+	cmd.PersistentFlags().BoolVarP(&opt.Verbose, "verbose", "v", opt.Verbose, "Display verbose output from the local server and nginx.")
 
 	if err := cmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
@@ -57,53 +106,160 @@ type Options struct {
 	CacheDir     string
 	MaxCacheSize string
 	CacheTimeout string
+	CacheRules   []string
+
+	UpstreamCABundle string
+	VerifyUpstreams  bool
+
+	Variables     []string
+	VariableDirs  []string
+	Architectures []string
+	MirrorRefresh time.Duration
+
+	HealthInterval time.Duration
+	TunnelDir      string
+
+	NginxBinary string
+	RuntimeDir  string
 
 	Listen    string
 	LocalPort int
 	Verbose   bool
+
+	TLSCertificate string
+	TLSKey         string
+	TLSListen      string
+	TLSProtocols   []string
+	TLSCiphers     string
+	RedirectHTTP   bool
+
+	Frontends []string
+
+	ShutdownTimeout time.Duration
+
+	MaxRestarts       int
+	RestartWindow     time.Duration
+	MaxRestartBackoff time.Duration
+}
+
+// restartPolicy returns how nginx is restarted when it exits.
+func (opt *Options) restartPolicy() process.RestartPolicy {
+	policy := process.DefaultRestartPolicy
+	policy.MaxRestarts = opt.MaxRestarts
+	policy.Window = opt.RestartWindow
+	policy.MaxBackoff = opt.MaxRestartBackoff
+	if policy.InitialBackoff > policy.MaxBackoff {
+		policy.InitialBackoff = policy.MaxBackoff
+	}
+	return policy
+}
+
+// detectNginx returns the version and modules of the nginx process runs, and
+// configures process for that version.
+func (opt *Options) detectNginx(process *process.Process) (config.NginxFeatures, error) {
+	output, err := process.Version()
+	if err != nil {
+		return config.NginxFeatures{}, fmt.Errorf("unable to run %s -V: %v", opt.NginxBinary, err)
+	}
+	nginx, err := config.ParseNginxFeatures(output)
+	if err != nil {
+		return config.NginxFeatures{}, fmt.Errorf("unable to determine the version of %s: %v", opt.NginxBinary, err)
+	}
+	log.Printf("Using nginx %s", nginx.Version)
+	// older versions always open the error log they were built with
+	if nginx.AtLeast("1.19.5") {
+		process.SetArgs("-e", "stderr")
+	}
+	if !nginx.HasModule("http_auth_request_module") {
+		log.Printf("warn: nginx does not include http_auth_request_module, container registries will not be mirrored")
+	}
+	if !nginx.HasModule("http_ssl_module") {
+		log.Printf("warn: nginx does not include http_ssl_module, https upstreams cannot be mirrored")
+	}
+	return nginx, nil
 }
 
 // Run launches the configuration generator, the nginx process, and
-// an HTTP server for dynamic content.
+// an HTTP server for dynamic content. SIGHUP reloads the configuration,
+// SIGUSR1 is forwarded to nginx so it reopens its logs, and SIGTERM or SIGINT
+// shut everything down gracefully, returning an error if that was not clean.
 func (opt *Options) Run() error {
-	t, err := template.New("config").Parse(nginxConfigTemplate)
+	if opt.MaxRestarts < 0 || opt.RestartWindow <= 0 || opt.MaxRestartBackoff <= 0 {
+		return fmt.Errorf("--max-restarts must not be negative, and --restart-window and --max-restart-backoff must be positive")
+	}
+	process := process.New(opt.NginxBinary, opt.ConfigPath)
+	process.SetRestartPolicy(opt.restartPolicy())
+	// nginx is only run if the configuration is written to a file
+	var nginx config.NginxFeatures
+	if len(opt.ConfigPath) > 0 {
+		var err error
+		if nginx, err = opt.detectNginx(process); err != nil {
+			return err
+		}
+		if len(opt.RuntimeDir) > 0 {
+			if err := os.MkdirAll(opt.RuntimeDir, 0755); err != nil {
+				return fmt.Errorf("unable to create the nginx runtime directory: %v", err)
+			}
+		}
+	}
+
+	mirrors := config.NewMirrorResolver(&http.Client{Timeout: 30 * time.Second})
+	generator, err := opt.NewGenerator(opt.ConfigPath, mirrors, nginx)
 	if err != nil {
 		return err
 	}
 
-	level := "warn"
-	if opt.Verbose {
-		level = "debug"
-	}
-	cacheConfig := &config.CacheConfig{
-		LogLevel:         level,
-		LocalPort:        opt.LocalPort,
-		CacheDir:         opt.CacheDir,
-		MaxCacheSize:     opt.MaxCacheSize,
-		InactiveDuration: opt.CacheTimeout,
-		Frontends: []config.Frontend{
-			{
-				Listen: opt.Listen,
-			},
-		},
+	// tunnels must be listening before nginx loads a configuration that uses them
+	reloaders := []Reloader{tunnel.New(generator)}
+	if len(opt.ConfigPath) > 0 {
+		// the configuration is live once nginx has been told to load it
+		generator.SetValidator(process.Validate)
+		process.SetLoaded(generator.Activate)
+		reloaders = append(reloaders, process)
+	} else {
+		reloaders = append(reloaders, reloaderFunc(generator.Activate))
 	}
+	r := NewReloadManager(generator, reloaders...)
 
-	process := process.New(opt.ConfigPath)
-	generator := config.NewGenerator(opt.ConfigPath, t, cacheConfig)
-	r := NewReloadManager(generator, process)
+	// variable directories are watched alongside the configuration, but only
+	// the configuration paths are loaded
+	watched := append([]string{}, opt.Paths...)
+	for _, dir := range opt.VariableDirs {
+		if _, err := os.Stat(dir); err == nil {
+			watched = append(watched, dir)
+		}
+	}
+	// certificates are replaced by updating a symlink in their directory,
+	// and nginx loads them again when it reloads
+	certificateDirs, err := opt.certificateDirs()
+	if err != nil {
+		return err
+	}
+	watched = append(watched, certificateDirs...)
 
 	// the watcher coalesceses frequent file changes
-	w := watcher.New(opt.Paths, r.Load)
+	w := watcher.New(watched, func([]string) error { return r.Load(opt.Paths) })
 	w.SetMinimumInterval(10 * time.Millisecond)
 	w.SetMaxDelays(100)
 
+	if opt.MirrorRefresh > 0 {
+		go mirrors.Run(opt.MirrorRefresh, w.Trigger)
+	}
+
+	var server *http.Server
 	if opt.LocalPort > 0 {
-		handlers, err := NewHandlers(generator)
+		checker := health.New(opt.HealthInterval, 30*time.Second)
+		if opt.HealthInterval > 0 {
+			go checker.Run(generator)
+		}
+		charts := helm.New(generator, urlForRepo, 30*time.Second, time.Minute)
+		handlers, err := NewHandlers(generator, checker, process, registry.New(generator, 30*time.Second), charts)
 		if err != nil {
 			return err
 		}
+		server = &http.Server{Addr: fmt.Sprintf("localhost:%d", opt.LocalPort), Handler: handlers}
 		go func() {
-			if err := http.ListenAndServe(fmt.Sprintf("localhost:%d", opt.LocalPort), handlers); err != nil && err != http.ErrServerClosed {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 				log.Printf("error: server exited: %v", err)
 				os.Exit(1)
 			}
@@ -115,7 +271,153 @@ func (opt *Options) Run() error {
 		process.Run()
 	}
 
-	return w.Run()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1)
+	watcherDone := make(chan error, 1)
+	go func() {
+		watcherDone <- w.Run()
+	}()
+	for {
+		select {
+		case err := <-watcherDone:
+			return err
+		case sig := <-signals:
+			switch sig {
+			case syscall.SIGHUP:
+				log.Printf("Received %s, reloading configuration", sig)
+				w.Trigger()
+			case syscall.SIGUSR1:
+				// nginx reopens its log files
+				if err := process.Signal(sig); err != nil {
+					log.Printf("error: unable to signal nginx: %v", err)
+				}
+			default:
+				log.Printf("Received %s, shutting down", sig)
+				signal.Stop(signals)
+				w.Stop()
+				<-watcherDone
+				return opt.shutdown(process, server)
+			}
+		}
+	}
+}
+
+// shutdown waits for nginx to finish serving current requests and then
+// stops the local server, which nginx relies on until it exits. An error is
+// returned if either did not stop within the shutdown timeout.
+func (opt *Options) shutdown(process *process.Process, server *http.Server) error {
+	deadline := time.Now().Add(opt.ShutdownTimeout)
+	var errs []string
+	if err := process.Stop(opt.ShutdownTimeout); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if server != nil {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("the local server did not stop: %v", err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("shutdown was not clean: %s", strings.Join(errs, ", "))
+	}
+	log.Printf("Shutdown complete")
+	return nil
+}
+
+// caBundlePaths are the locations of the system CA bundle on common
+// distributions.
+var caBundlePaths = []string{
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// upstreamCABundle returns the CA bundle upstreams are verified with, which is
+// the system bundle unless one is set. An empty path is returned only if
+// upstreams are not verified.
+func (opt *Options) upstreamCABundle() (string, error) {
+	if len(opt.UpstreamCABundle) > 0 {
+		if _, err := os.Stat(opt.UpstreamCABundle); err != nil {
+			return "", fmt.Errorf("--upstream-ca-bundle: %v", err)
+		}
+		return opt.UpstreamCABundle, nil
+	}
+	if !opt.VerifyUpstreams {
+		return "", nil
+	}
+	for _, path := range caBundlePaths {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no CA bundle was found at %s, set --upstream-ca-bundle or disable verification with --verify-upstream-tls=false", strings.Join(caBundlePaths, ", "))
+}
+
+// NewGenerator creates a generator for the options that writes to configPath,
+// resolving mirror lists with mirrors.
+func (opt *Options) NewGenerator(configPath string, mirrors *config.MirrorResolver, nginx config.NginxFeatures) (*config.Generator, error) {
+	t, err := template.New("config").Parse(nginxConfigTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	level := "warn"
+	if opt.Verbose {
+		level = "debug"
+	}
+	overrides := make(config.Variables)
+	for _, v := range opt.Variables {
+		name, value, err := config.ParseVariable(v)
+		if err != nil {
+			return nil, err
+		}
+		overrides[name] = value
+	}
+	var cacheRules []config.CacheRule
+	for _, s := range opt.CacheRules {
+		rule, err := config.ParseCacheRule(s)
+		if err != nil {
+			return nil, fmt.Errorf("--cache-rule %q: %v", s, err)
+		}
+		cacheRules = append(cacheRules, rule)
+	}
+	frontends, err := opt.frontends(nginx)
+	if err != nil {
+		return nil, err
+	}
+	caBundle, err := opt.upstreamCABundle()
+	if err != nil {
+		return nil, err
+	}
+
+	cacheConfig := &config.CacheConfig{
+		LogLevel:         level,
+		LocalPort:        opt.LocalPort,
+		CacheDir:         opt.CacheDir,
+		MaxCacheSize:     opt.MaxCacheSize,
+		InactiveDuration: opt.CacheTimeout,
+		RuntimeDir:       strings.TrimRight(opt.RuntimeDir, "/"),
+		Nginx:            nginx,
+		Frontends:        frontends,
+	}
+
+	generator := config.NewGenerator(configPath, t, cacheConfig)
+	generator.SetLoadOptions(config.LoadOptions{
+		CABundlePath: caBundle,
+		VerifyTLS:    opt.VerifyUpstreams,
+
+		VariableDirs:  opt.VariableDirs,
+		Overrides:     overrides,
+		Architectures: opt.Architectures,
+
+		Mirrors:   mirrors,
+		TunnelDir: opt.TunnelDir,
+
+		CacheRules: cacheRules,
+	})
+	return generator, nil
 }
 
 // Loader reads and generates a configuration for the given paths.
@@ -128,25 +430,43 @@ type Reloader interface {
 	Reload()
 }
 
-// reloadManager ties a Loader and Reloader together.
+// reloaderFunc is a Reloader that invokes itself.
+type reloaderFunc func()
+
+func (fn reloaderFunc) Reload() {
+	fn()
+}
+
+// reloadManager ties a Loader and Reloaders together.
 type reloadManager struct {
-	loader   Loader
-	reloader Reloader
+	loader    Loader
+	reloaders []Reloader
+	loaded    bool
 }
 
-// NewReloadManager ensures that the provided reloader is called whenever
-// the configuration is loaded successfully.
-func NewReloadManager(loader Loader, reloader Reloader) Loader {
+// NewReloadManager ensures that the provided reloaders are called in order
+// whenever the configuration is loaded successfully. Once a configuration has
+// been loaded, errors loading later configurations are logged instead of
+// returned.
+func NewReloadManager(loader Loader, reloaders ...Reloader) Loader {
 	return &reloadManager{
-		loader:   loader,
-		reloader: reloader,
+		loader:    loader,
+		reloaders: reloaders,
 	}
 }
 
 func (m *reloadManager) Load(paths []string) error {
 	if err := m.loader.Load(paths); err != nil {
+		// the last valid configuration remains in place
+		if _, ok := err.(*config.ValidationError); ok || m.loaded {
+			log.Printf("error: %v", err)
+			return nil
+		}
 		return err
 	}
-	m.reloader.Reload()
+	m.loaded = true
+	for _, reloader := range m.reloaders {
+		reloader.Reload()
+	}
 	return nil
 }
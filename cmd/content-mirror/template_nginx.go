@@ -1,11 +1,153 @@
 package main
 
 const nginxConfigTemplate = `
+{{- define "upstream-tls" }}
+  {{- if .TLS }}
+      proxy_ssl_session_reuse on;
+      {{- if gt (len .ServerName) 0 }}
+      proxy_ssl_server_name on;
+      proxy_ssl_name {{ .ServerName }};
+      {{- end }}
+      {{- if gt (len .CACertificatePath) 0 }}
+      proxy_ssl_verify       on;
+      proxy_ssl_verify_depth 5;
+      proxy_ssl_trusted_certificate {{ .CACertificatePath }};
+      {{- end }}
+      {{- if gt (len .CertificatePath) 0 }}
+      proxy_ssl_certificate     {{ .CertificatePath }};
+      proxy_ssl_certificate_key {{ .KeyPath }};
+      {{- end }}
+  {{- end }}
+{{- end }}
+{{- define "upstream-fallback" }}
+  {{- if gt (len .Fallback) 0 }}
+      # Try the next mirror when this one fails or does not have the content
+      proxy_intercept_errors on;
+      recursive_error_pages on;
+      error_page 404 500 502 503 504 = @{{ .Fallback }};
+  {{- end }}
+{{- end }}
+{{- define "upstream-headers" }}
+      proxy_set_header Host {{ or .HostHeader (index .Hosts 0) }};
+      {{- if gt (len .Authorization) 0 }}
+      proxy_set_header Authorization "{{ .Authorization }}";
+      {{- end }}
+      {{- range .Headers }}
+      proxy_set_header {{ .Name }} "{{ .Value }}";
+      {{- end }}
+      {{- template "upstream-tls" . }}
+{{- end }}
+{{- define "cache-policy" }}
+      {{- if .NoCache }}
+      proxy_cache off;
+      {{- else }}
+      {{- if .TTL }}
+      proxy_cache_valid 200 206 {{ .TTL }};
+      {{- end }}
+      {{- if .NegativeTTL }}
+      proxy_cache_valid 404 410 {{ .NegativeTTL }};
+      {{- end }}
+      {{- if .Stale }}
+      proxy_cache_use_stale{{ range .Stale }} {{ . }}{{ end }};
+      {{- end }}
+      {{- if .VaryOnAccept }}
+      proxy_cache_key $scheme$request_uri$http_accept;
+      {{- end }}
+      {{- end }}
+{{- end }}
+{{- define "upstream-location" }}
+      proxy_pass {{ .URL }};
+
+      # Report the cache status as a header
+      add_header X-Proxy-CacheConfig   $upstream_cache_status;
+      {{- template "upstream-headers" . }}
+      {{- template "upstream-fallback" . }}
+      {{- if .Rewrites }}
+
+      # Rewrite links to other upstreams so they are retrieved through the mirror
+      proxy_set_header Accept-Encoding "";
+      sub_filter_types text/html application/json application/vnd.pypi.simple.v1+html application/vnd.pypi.simple.v1+json application/vnd.npm.install-v1+json;
+      sub_filter_once off;
+      {{- range .Rewrites }}
+      sub_filter "{{ .From }}" "$content_mirror_scheme://$http_host/{{ .To }}/";
+      {{- end }}
+      {{- end }}
+      {{- if or .Cache.TTL .Cache.NoCache }}
+
+      {{ if .Cache.Description }}# {{ .Cache.Description }}{{ end }}
+      {{- template "cache-policy" .Cache }}
+      {{- end }}
+      {{- $upstream := . }}
+      {{- range .CacheRules }}
+
+      {{ if .Description }}# {{ .Description }}
+      {{ end }}location ~ "^(?:/_mirror)?/{{ $upstream.Name }}/({{ .Pattern }})$" {
+        proxy_pass {{ $upstream.URL }}$1;
+        {{- template "cache-policy" . }}
+        {{- if not (or .NoCache .VaryOnAccept) }}
+        proxy_cache_key $scheme$request_uri;
+        {{- end }}
+        {{- template "upstream-headers" $upstream }}
+      }
+      {{- end }}
+{{- end }}
+{{- define "registry-headers" }}
+      proxy_set_header Host {{ index .Hosts 0 }};
+      # Supplied by the local server, which authenticates to the registry
+      proxy_set_header Authorization $registry_authorization;
+      # Clients never authenticate to the registry themselves
+      proxy_hide_header WWW-Authenticate;
+      {{- template "upstream-tls" . }}
+{{- end }}
+{{- define "registry-location" }}
+    location /v2/{{ .Name }}/ {
+      auth_request /_registry/{{ .Name }}/token;
+      auth_request_set $registry_authorization $upstream_http_x_registry_authorization;
+
+      proxy_pass {{ .URL }}v2/;
+
+      # Report the cache status as a header
+      add_header X-Proxy-CacheConfig   $upstream_cache_status;
+      {{- template "registry-headers" . }}
+
+      # Registries redirect to blob storage, which is followed by the local
+      # server so the content is cached under the original request
+      proxy_intercept_errors on;
+      error_page 301 302 303 307 308 = @{{ .Name }}-redirect;
+
+      # Tags are moved and the format of a manifest depends on what the client
+      # accepts.
+      proxy_cache_valid 200 60s;
+      proxy_cache_key $scheme$request_uri$http_accept;
+
+      # Manifests and blobs are addressed by the digest of their content and
+      # never change.
+      location ~ ^/v2/{{ .Name }}/(.+/(?:manifests|blobs)/[a-z0-9]+:[a-f0-9]+)$ {
+        proxy_pass {{ .URL }}v2/$1;
+
+        proxy_cache_valid 200 1y;
+        proxy_cache_key $scheme$request_uri;
+        proxy_ignore_headers Cache-Control Expires;
+        {{- template "registry-headers" . }}
+      }
+    }
+    location @{{ .Name }}-redirect {
+      set $registry_location $upstream_http_location;
+      proxy_pass http://localhost/_registry/{{ .Name }}/redirect;
+      proxy_set_header Host localhost;
+      proxy_set_header X-Registry-Location $registry_location;
+
+      proxy_cache_valid 200 1y;
+    }
+{{- end }}
 {{ $config := . -}}
 worker_processes  5;  ## Default: 1
 worker_rlimit_nofile 8192;
 error_log stderr {{ .LogLevel }};
 daemon off;
+{{- if .RuntimeDir }}
+pid {{ .RuntimeDir }}/nginx.pid;
+{{- end }}
 
 events {
   worker_connections  4096;  ## Default: 1024
@@ -15,13 +157,31 @@ http {
   sendfile     on;
   tcp_nopush   on;
   server_names_hash_bucket_size 128; # this seems to be required for some vhosts
+{{- if .RuntimeDir }}
+
+  access_log {{ .RuntimeDir }}/access.log;
+  client_body_temp_path {{ .RuntimeDir }}/client_body;
+  proxy_temp_path {{ .RuntimeDir }}/proxy_temp;
+  fastcgi_temp_path {{ .RuntimeDir }}/fastcgi_temp;
+  uwsgi_temp_path {{ .RuntimeDir }}/uwsgi_temp;
+  scgi_temp_path {{ .RuntimeDir }}/scgi_temp;
+{{- end }}
 
-  proxy_cache_path {{ .CacheDir }} levels=1:2 keys_zone=shared_cache:10m max_size={{ .MaxCacheSize }} inactive={{ .InactiveDuration }} use_temp_path=off;
+  proxy_cache_path {{ .CacheDir }} levels=1:2 keys_zone=shared_cache:10m max_size={{ .MaxCacheSize }} inactive={{ .InactiveDuration }}{{ if .Nginx.AtLeast "1.7.10" }} use_temp_path=off{{ end }};
 
   proxy_cache_use_stale error timeout http_500 http_502 http_503 http_504;
   proxy_cache_revalidate on;
   proxy_cache_min_uses 1;
+  {{- if .Nginx.AtLeast "1.11.10" }}
   proxy_cache_background_update on;
+  {{- end }}
+
+  # The scheme clients use to reach the mirror, which may be behind a proxy
+  map $http_x_forwarded_proto $content_mirror_scheme {
+    default $scheme;
+    http    http;
+    https   https;
+  }
 
 {{- if gt .LocalPort 0 }}
   upstream localhost {
@@ -29,25 +189,61 @@ http {
     server localhost:{{ .LocalPort }};
   }
 {{- end }}
-{{ $upstreams := .Upstreams }}
+
 {{- range .Upstreams }}
+{{- range .Origins }}
   upstream {{ .Name }} {
     keepalive 10;
+    {{- if gt (len .Tunnel) 0 }}
+    # via proxy {{ .Proxy }}
+    server unix:{{ .Tunnel }};
+    {{- else }}
     {{- range .Hosts }}
     server {{ . }};
     {{- end }}
+    {{- end }}
   }
 {{- end }}
+{{- end }}
 {{- range .Frontends }}
+  {{- $frontend := . }}
+  {{- $exposed := $config.Exposed . }}
+  # Frontend {{ .Name }}
   server {
-    listen {{ .Listen }};
+    listen {{ .Listen }}{{ if gt (len .CertificatePath) 0 }} ssl{{ end }};
+    {{- if .ServerNames }}
+    server_name{{ range .ServerNames }} {{ . }}{{ end }};
+    {{- end }}
 
     {{- if gt (len .CertificatePath) 0 }}
-    ssl_certificate {{ .CertificatePath }}
-    ssl_certificate_key {{ .KeyPath }}
+    ssl_certificate     {{ .CertificatePath }};
+    ssl_certificate_key {{ .KeyPath }};
+    {{- if .Protocols }}
+    ssl_protocols{{ range .Protocols }} {{ . }}{{ end }};
+    {{- end }}
+    {{- if .Ciphers }}
+    ssl_ciphers {{ .Ciphers }};
+    {{- end }}
+    ssl_session_cache shared:SSL:10m;
+    {{- end }}
+    {{- if .HTTPSRedirectPort }}
+
+    # Content is only served over HTTPS
+    {{- if gt $config.LocalPort 0 }}
+    location /healthz {
+      proxy_cache off;
+      proxy_pass http://localhost;
+    }
     {{- end }}
+    location / {
+      return 301 https://$host{{ if ne .HTTPSRedirectPort "443" }}:{{ .HTTPSRedirectPort }}{{ end }}$request_uri;
+    }
+    {{- else }}
 
     proxy_cache shared_cache;
+    proxy_cache_valid 200 302 {{ $config.InactiveDuration }};
+    # Mirrors of an upstream share cached content
+    proxy_cache_key $scheme$request_uri;
 
     # Allow keepalive
     proxy_http_version 1.1;
@@ -55,80 +251,120 @@ http {
     # it could be "close" to close a keepalive connection
     proxy_set_header Connection "";
 
-    {{ range $upstreams -}}
-    location /{{ .Name }}/ {
-      proxy_pass {{ .URL }};
 
-      # Enable caching and report the status as a header
-      proxy_cache_valid 200 302 {{ $config.InactiveDuration }};
-      add_header X-Proxy-CacheConfig   $upstream_cache_status;
-      proxy_set_header Host {{ index .Hosts 0 }};
+    {{- if and ($exposed.HasUpstreamType "registry") (gt $config.LocalPort 0) ($config.Nginx.HasModule "http_auth_request_module") }}
+    # Container registries are served under /v2/<name>/
+    location = /v2/ {
+      default_type application/json;
+      add_header Docker-Distribution-API-Version registry/2.0 always;
+      return 200 '{}';
+    }
+    location /_registry/ {
+      internal;
+      proxy_cache off;
+      proxy_pass http://localhost;
+      proxy_pass_request_body off;
+      proxy_set_header Content-Length "";
+      proxy_set_header X-Original-URI $request_uri;
+    }
+    {{- end }}
 
-      {{- if .TLS }}
-      proxy_ssl_session_reuse on;
-      {{- if gt (len .CACertificatePath) 0 }}
-      proxy_ssl_verify       on;
-      proxy_ssl_trusted_certificate {{ .CACertificatePath }};
-      {{- end }}
-      {{- if gt (len .CertificatePath) 0 }}
-      proxy_ssl_certificate     {{ .CertificatePath }};
-      proxy_ssl_certificate_key {{ .KeyPath }};
+    {{- range $exposed.Upstreams }}
+    {{- $upstream := . }}
+    {{- if eq .Type "registry" }}
+    {{- if and (gt $config.LocalPort 0) ($config.Nginx.HasModule "http_auth_request_module") }}
+    {{- template "registry-location" . }}
+    {{- end }}
+    {{- else }}
+    location /{{ .Name }}/ {
+      {{- template "upstream-location" . }}
+      {{- range .Routes }}
+
+      location ^~ /{{ $upstream.Name }}/{{ .Path }} {
+        rewrite ^/{{ $upstream.Name }}/{{ .Path }}(.*)$ /{{ .To }}/$1 last;
+      }
+      {{- if eq $upstream.Type "goproxy" }}
+      # The checksum database is always available through the mirror
+      location = /{{ $upstream.Name }}/{{ .Path }}supported {
+        return 200;
+      }
       {{- end }}
       {{- end }}
+      {{- if and (eq .Type "helm") (gt $config.LocalPort 0) }}
 
-      # Do not cache repomd.xml for long. These need to be pulled from the
-      # mirrored server regularly. When a yum repository is rebuilt, references in an old
-      # copy of repomd.xml will no longer resolve - resulting in 404s.
-      location ~ ^.*/(repodata/repomd\.xml) {
-        proxy_pass {{ .URL }}$1;
-        
-        proxy_cache_valid 200 206 60s; 
-        
-        proxy_set_header Host {{ index .Hosts 0 }};
-        
-        {{- if .TLS }}
-        proxy_ssl_session_reuse on;
-        {{- if gt (len .CACertificatePath) 0 }}
-        proxy_ssl_verify       on;
-        proxy_ssl_trusted_certificate {{ .CACertificatePath }};
-        {{- end }}
-        {{- if gt (len .CertificatePath) 0 }}
-        proxy_ssl_certificate     {{ .CertificatePath }};
-        proxy_ssl_certificate_key {{ .KeyPath }};
-        {{- end }}
-        {{- end }}
-      
+      # The index is rewritten by the local server to refer to the mirror
+      location = /{{ .Name }}/index.yaml {
+        proxy_cache off;
+        proxy_pass http://localhost/_helm/{{ .Name }}/index.yaml;
+        proxy_set_header Host $http_host;
+        proxy_set_header X-Forwarded-Proto $content_mirror_scheme;
       }
-
+      # Charts the index links to on other hosts are retrieved by the local
+      # server
+      location ^~ /{{ .Name }}/_charts/ {
+        proxy_pass http://localhost/_helm/{{ .Name }}/charts/;
+        proxy_set_header Host $http_host;
+      }
+      {{- end }}
     }
+    {{- range .Mirrors }}
+    location @{{ .Name }} {
+      rewrite ^/(?:_mirror/[^/]+|{{ $upstream.Name }})/(.*)$ /_mirror/{{ .Name }}/$1 last;
+    }
+    location /_mirror/{{ .Name }}/ {
+      internal;
+      {{- template "upstream-location" . }}
+    }
+    {{- end }}
     location = /{{ .Name }} {
       rewrite ^ /{{ .Name }}/ redirect;
     }
     {{- if gt $config.LocalPort 0 }}
     location /{{ .Name }} {
+      proxy_cache off;
       proxy_pass http://localhost;
       proxy_set_header Host $http_host;
       proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
       proxy_set_header X-Forwarded-Proto $scheme;
+      proxy_set_header X-Content-Mirror-Frontend {{ $frontend.Name }};
     }
     {{- end }}
     {{- end }}
+    {{- end }}
 
     {{- if gt $config.LocalPort 0 }}
+    {{- if $exposed.HasUpstreamType "apk" }}
+    location = /repositories {
+      proxy_cache off;
+      proxy_pass http://localhost;
+      proxy_set_header Host $http_host;
+      proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+      proxy_set_header X-Forwarded-Proto $scheme;
+      proxy_set_header X-Content-Mirror-Frontend {{ $frontend.Name }};
+    }
+    {{- end }}
     location /healthz {
+      proxy_cache off;
+      proxy_pass http://localhost;
+    }
+    location = /status {
+      proxy_cache off;
       proxy_pass http://localhost;
     }
     location = / {
+      proxy_cache off;
       proxy_pass http://localhost;
       proxy_set_header Host $http_host;
       proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
       proxy_set_header X-Forwarded-Proto $scheme;
+      proxy_set_header X-Content-Mirror-Frontend {{ $frontend.Name }};
     }
     {{- end }}
 
     location / {
       return 404;
     }
+    {{- end }}
   }
 {{- end }}
 }
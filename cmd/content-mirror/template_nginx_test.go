@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/openshift/content-mirror/pkg/config"
+)
+
+// namedRewrites returns the rewrite of each named location in the rendered
+// configuration.
+func namedRewrites(t *testing.T, rendered string) map[string][2]string {
+	rewrites := make(map[string][2]string)
+	re := regexp.MustCompile(`location @(\S+) \{\s+rewrite (\S+) (\S+) last;`)
+	for _, m := range re.FindAllStringSubmatch(rendered, -1) {
+		rewrites[m[1]] = [2]string{m[2], m[3]}
+	}
+	return rewrites
+}
+
+func TestMirrorFallbackRewrites(t *testing.T) {
+	tmpl, err := template.New("config").Parse(nginxConfigTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := func(name, host, fallback string) config.Upstream {
+		return config.Upstream{
+			Name:     name,
+			URL:      "http://" + name + "/repo/",
+			Hosts:    []string{host},
+			Origin:   "http://" + host + "/repo/",
+			Path:     "/repo/",
+			Fallback: fallback,
+		}
+	}
+	upstream := origin("base", "a.example.com", "base-mirror-1")
+	upstream.Mirrors = []config.Upstream{
+		origin("base-mirror-1", "b.example.com", "base-mirror-2"),
+		origin("base-mirror-2", "c.example.com", "base-mirror-3"),
+		origin("base-mirror-3", "d.example.com", ""),
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &config.CacheConfig{
+		CacheDir:         "/tmp/cache",
+		MaxCacheSize:     "1g",
+		InactiveDuration: "15m",
+		LogLevel:         "warn",
+		Frontends:        []config.Frontend{{Listen: "8080"}},
+		Upstreams:        []config.Upstream{upstream},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rewrites := namedRewrites(t, buf.String())
+
+	// each failed origin falls back to the next one in order, whether the
+	// request was for the upstream or already rewritten to a mirror
+	tests := []struct {
+		location string
+		uri      string
+		want     string
+	}{
+		{location: "base-mirror-1", uri: "/base/repodata/repomd.xml", want: "/_mirror/base-mirror-1/repodata/repomd.xml"},
+		{location: "base-mirror-2", uri: "/_mirror/base-mirror-1/repodata/repomd.xml", want: "/_mirror/base-mirror-2/repodata/repomd.xml"},
+		{location: "base-mirror-3", uri: "/_mirror/base-mirror-2/Packages/a.rpm", want: "/_mirror/base-mirror-3/Packages/a.rpm"},
+	}
+	for _, tt := range tests {
+		rewrite, ok := rewrites[tt.location]
+		if !ok {
+			t.Errorf("no rewrite in location @%s", tt.location)
+			continue
+		}
+		re, err := regexp.Compile(rewrite[0])
+		if err != nil {
+			t.Errorf("@%s: %v", tt.location, err)
+			continue
+		}
+		if !re.MatchString(tt.uri) {
+			t.Errorf("@%s: %s does not match %s", tt.location, rewrite[0], tt.uri)
+			continue
+		}
+		got := re.ReplaceAllString(tt.uri, strings.Replace(rewrite[1], "$1", "${1}", -1))
+		if got != tt.want {
+			t.Errorf("@%s: %s was rewritten to %s, want %s", tt.location, tt.uri, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/openshift/content-mirror/pkg/config"
+	"github.com/openshift/content-mirror/pkg/process"
+)
+
+// NewValidateCommand checks the configuration in the provided paths once.
+func NewValidateCommand(opt *Options) *cobra.Command {
+	var nginx bool
+	cmd := &cobra.Command{
+		Use:   "validate [PATH...]",
+		Short: "Check that every configuration file can be loaded",
+		Long: `Load the configuration files in each path once and report any file,
+section or upstream name that would be rejected or renamed. Exits with a
+non-zero status if there are any problems.`,
+
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				opt.Paths = args
+			}
+			return opt.Validate(nginx)
+		},
+	}
+	cmd.Flags().BoolVar(&nginx, "nginx", nginx, "Check the generated configuration with nginx -t.")
+	return cmd
+}
+
+// NewRenderCommand prints the configuration generated for the provided paths.
+func NewRenderCommand(opt *Options) *cobra.Command {
+	format := "nginx"
+	var showCredentials bool
+	cmd := &cobra.Command{
+		Use:   "render [PATH...]",
+		Short: "Print the configuration generated for the configuration files",
+
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				opt.Paths = args
+			}
+			return opt.Render(format, showCredentials)
+		},
+	}
+	cmd.Flags().StringVarP(&format, "output", "o", format, "The format to print, nginx for the nginx configuration or json for the loaded upstreams.")
+	cmd.Flags().BoolVar(&showCredentials, "show-credentials", showCredentials, "Include credentials in the output instead of redacting them.")
+	return cmd
+}
+
+// Validate loads the configuration once and returns an error if any input
+// was rejected or renamed, or if checkNginx is set and nginx rejects the
+// generated configuration.
+func (opt *Options) Validate(checkNginx bool) error {
+	var nginx config.NginxFeatures
+	nginxProcess := process.New(opt.NginxBinary, "")
+	if checkNginx {
+		var err error
+		if nginx, err = opt.detectNginx(nginxProcess); err != nil {
+			return err
+		}
+		// nginx -t opens the logs and creates the temporary directories
+		if len(opt.RuntimeDir) > 0 {
+			if err := os.MkdirAll(opt.RuntimeDir, 0755); err != nil {
+				return fmt.Errorf("unable to create the nginx runtime directory: %v", err)
+			}
+		}
+	}
+	mirrors := config.NewMirrorResolver(&http.Client{Timeout: 30 * time.Second})
+	generator, err := opt.NewGenerator("", mirrors, nginx)
+	if err != nil {
+		return err
+	}
+	cfg, err := generator.Generate(opt.Paths)
+	if err != nil {
+		return err
+	}
+	problems := len(generator.Rejected()) + len(generator.Renamed())
+
+	if checkNginx {
+		data, err := generator.Render(cfg)
+		if err != nil {
+			return err
+		}
+		f, err := ioutil.TempFile("", "content-mirror-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.Write(data)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		if err := nginxProcess.Validate(f.Name()); err != nil {
+			fmt.Fprintf(os.Stderr, "error: the generated configuration is not valid:\n%v\n", err)
+			problems++
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("the configuration has problems (%d)", problems)
+	}
+	fmt.Fprintf(os.Stdout, "%d upstreams are valid\n", len(cfg.Upstreams))
+	return nil
+}
+
+// Render prints the configuration generated for the paths in format, which
+// is nginx or json.
+func (opt *Options) Render(format string, showCredentials bool) error {
+	if format != "nginx" && format != "json" {
+		return fmt.Errorf("--output must be nginx or json")
+	}
+	mirrors := config.NewMirrorResolver(&http.Client{Timeout: 30 * time.Second})
+	generator, err := opt.NewGenerator("", mirrors, config.NginxFeatures{})
+	if err != nil {
+		return err
+	}
+	cfg, err := generator.Generate(opt.Paths)
+	if err != nil {
+		return err
+	}
+	if !showCredentials {
+		cfg = cfg.Redacted()
+	}
+	if format == "json" {
+		data, err := json.MarshalIndent(cfg, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", data)
+		return nil
+	}
+	data, err := generator.Render(cfg)
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(data)
+	return nil
+}
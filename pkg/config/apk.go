@@ -0,0 +1,98 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadAPKRepositoriesUpstreams loads an Alpine repositories file, which lists
+// one repository URL per line, optionally prefixed with @tag. Each repository
+// is named after the file and the last two elements of its path, such as
+// alpine-v3.18-main.
+func LoadAPKRepositoriesUpstreams(repositoriesFile string, opts LoadOptions) ([]Upstream, error) {
+	f, err := os.Open(repositoriesFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	base := strings.TrimSuffix(filepath.Base(repositoriesFile), ".repositories")
+	if base == "repositories" {
+		base = "alpine"
+	}
+	var upstreams []Upstream
+	names := make(map[string]struct{})
+	seen := make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i != -1 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		var tag string
+		if strings.HasPrefix(fields[0], "@") {
+			tag = strings.TrimPrefix(fields[0], "@")
+			fields = fields[1:]
+			if len(tag) == 0 {
+				return nil, fmt.Errorf("line %d: the tag is empty", line)
+			}
+		}
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("line %d: expected a repository URL, optionally prefixed with @tag", line)
+		}
+		u, err := url.Parse(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: the URL %s is not valid: %v", line, fields[0], err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			log.Printf("warn: APK repository %s in %s will be ignored, only http and https are supported", fields[0], repositoriesFile)
+			continue
+		}
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		if _, ok := seen[u.String()]; ok {
+			continue
+		}
+		seen[u.String()] = struct{}{}
+
+		name := apkRepositoryName(base, u.Path)
+		if _, ok := names[name]; ok {
+			name = fmt.Sprintf("%s-%d", name, len(upstreams))
+		}
+		names[name] = struct{}{}
+
+		upstream := chainOrigins(UpstreamTypeAPK, []Upstream{newOrigin(name, u, opts)})
+		upstream.Repo = true
+		upstream.APKTag = tag
+		upstreams = append(upstreams, upstream)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return upstreams, nil
+}
+
+// apkRepositoryName returns base followed by the last two elements of path.
+func apkRepositoryName(base, path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) > 2 {
+		segments = segments[len(segments)-2:]
+	}
+	name := base
+	for _, segment := range segments {
+		if len(segment) > 0 {
+			name += "-" + segment
+		}
+	}
+	return name
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadAPKRepositoriesUpstreams(t *testing.T) {
+	// apkSummary is the part of an APK upstream the tests compare.
+	type apkSummary struct {
+		Name   string
+		Origin string
+		Tag    string
+	}
+	tests := []struct {
+		name    string
+		file    string
+		data    string
+		want    []apkSummary
+		wantErr bool
+	}{
+		{
+			name: "repositories are named after their last two path elements",
+			file: "repositories",
+			data: `# the default repositories
+https://dl.example.com/alpine/v3.18/main
+https://dl.example.com/alpine/v3.18/community/  # trailing comment
+
+@edge http://dl.example.com/alpine/edge/testing
+`,
+			want: []apkSummary{
+				{Name: "alpine-v3.18-main", Origin: "https://dl.example.com/alpine/v3.18/main/"},
+				{Name: "alpine-v3.18-community", Origin: "https://dl.example.com/alpine/v3.18/community/"},
+				{Name: "alpine-edge-testing", Origin: "http://dl.example.com/alpine/edge/testing/", Tag: "edge"},
+			},
+		},
+		{
+			name: "the file name is used as the base",
+			file: "builder.repositories",
+			data: "https://dl.example.com/alpine/v3.18/main\n",
+			want: []apkSummary{{Name: "builder-v3.18-main", Origin: "https://dl.example.com/alpine/v3.18/main/"}},
+		},
+		{
+			name: "duplicate URLs are skipped and duplicate names are numbered",
+			file: "repositories",
+			data: `https://a.example.com/alpine/v3.18/main
+https://a.example.com/alpine/v3.18/main/
+https://b.example.com/alpine/v3.18/main
+`,
+			want: []apkSummary{
+				{Name: "alpine-v3.18-main", Origin: "https://a.example.com/alpine/v3.18/main/"},
+				{Name: "alpine-v3.18-main-1", Origin: "https://b.example.com/alpine/v3.18/main/"},
+			},
+		},
+		{
+			name: "short paths",
+			file: "repositories",
+			data: "https://a.example.com/main\nhttps://b.example.com/\n",
+			want: []apkSummary{
+				{Name: "alpine-main", Origin: "https://a.example.com/main/"},
+				{Name: "alpine", Origin: "https://b.example.com/"},
+			},
+		},
+		{
+			name: "only http and https are mirrored",
+			file: "repositories",
+			data: "/media/cdrom/apks\nftp://a.example.com/alpine/v3.18/main\nhttps://b.example.com/alpine/v3.18/main\n",
+			want: []apkSummary{{Name: "alpine-v3.18-main", Origin: "https://b.example.com/alpine/v3.18/main/"}},
+		},
+		{name: "empty tag", file: "repositories", data: "@ https://a.example.com/alpine/v3.18/main\n", wantErr: true},
+		{name: "tag without a URL", file: "repositories", data: "@edge\n", wantErr: true},
+		{name: "more than one URL", file: "repositories", data: "https://a.example.com/main https://b.example.com/main\n", wantErr: true},
+		{name: "invalid URL", file: "repositories", data: "https://a.example.com/%zz\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, tt.file, tt.data)
+			defer os.RemoveAll(filepath.Dir(path))
+			upstreams, err := LoadAPKRepositoriesUpstreams(path, LoadOptions{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []apkSummary
+			for _, u := range upstreams {
+				if u.Type != UpstreamTypeAPK || !u.Repo {
+					t.Errorf("upstream %s has type %s and repo %t", u.Name, u.Type, u.Repo)
+				}
+				got = append(got, apkSummary{Name: u.Name, Origin: u.Origin, Tag: u.APKTag})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
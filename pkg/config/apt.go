@@ -0,0 +1,265 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// APTEntry is a single source from a sources.list or deb822 .sources file.
+type APTEntry struct {
+	Types      []string
+	Suites     []string
+	Components []string
+	Options    []APTOption
+}
+
+// APTOption is an option of an APT source, such as arch or signed-by, using
+// the name from the one-line format.
+type APTOption struct {
+	Name  string
+	Value string
+}
+
+// aptOptionFields maps one-line option names to deb822 field names.
+var aptOptionFields = map[string]string{
+	"arch":                        "Architectures",
+	"lang":                        "Languages",
+	"target":                      "Targets",
+	"pdiffs":                      "PDiffs",
+	"by-hash":                     "By-Hash",
+	"allow-insecure":              "Allow-Insecure",
+	"allow-weak":                  "Allow-Weak",
+	"allow-downgrade-to-insecure": "Allow-Downgrade-To-Insecure",
+	"trusted":                     "Trusted",
+	"signed-by":                   "Signed-By",
+	"check-valid-until":           "Check-Valid-Until",
+	"valid-until-min":             "Valid-Until-Min",
+	"valid-until-max":             "Valid-Until-Max",
+	"check-date":                  "Check-Date",
+	"date-max-future":             "Date-Max-Future",
+	"inrelease-path":              "InRelease-Path",
+}
+
+// Field returns the deb822 field name of the option.
+func (o APTOption) Field() string {
+	if field, ok := aptOptionFields[o.Name]; ok {
+		return field
+	}
+	return o.Name
+}
+
+// Deb822Value returns the value formatted to follow the colon of a deb822
+// field. Values with more than one line start on a continuation line, and
+// empty lines are represented by a dot.
+func (o APTOption) Deb822Value() string {
+	if !strings.Contains(o.Value, "\n") {
+		return " " + o.Value
+	}
+	lines := strings.Split(o.Value, "\n")
+	for i := range lines {
+		if len(strings.TrimSpace(lines[i])) == 0 {
+			lines[i] = "."
+		}
+	}
+	return "\n " + strings.Join(lines, "\n ")
+}
+
+// ListOptions returns the options that can be expressed in a one-line entry,
+// separated by spaces.
+func (e APTEntry) ListOptions() string {
+	var options []string
+	for _, o := range e.Options {
+		// an inline key cannot be expressed in the one-line format
+		if strings.Contains(o.Value, "\n") {
+			continue
+		}
+		options = append(options, fmt.Sprintf("%s=%s", o.Name, o.Value))
+	}
+	return strings.Join(options, " ")
+}
+
+// aptSource is an entry and the URI it refers to.
+type aptSource struct {
+	uri   string
+	entry APTEntry
+}
+
+// LoadAPTListUpstreams loads the one-line entries of a sources.list file.
+func LoadAPTListUpstreams(listFile string, opts LoadOptions) ([]Upstream, error) {
+	f, err := os.Open(listFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var sources []aptSource
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i != -1 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		entry := APTEntry{Types: []string{fields[0]}}
+		switch fields[0] {
+		case "deb", "deb-src":
+		default:
+			return nil, fmt.Errorf("line %d: unrecognized source type %q", line, fields[0])
+		}
+		fields = fields[1:]
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "[") {
+			var options []string
+			for len(fields) > 0 {
+				field := fields[0]
+				fields = fields[1:]
+				closed := strings.HasSuffix(field, "]")
+				options = append(options, strings.Fields(strings.Trim(field, "[]"))...)
+				if closed {
+					break
+				}
+			}
+			for _, option := range options {
+				parts := strings.SplitN(option, "=", 2)
+				if len(parts) != 2 {
+					return nil, fmt.Errorf("line %d: option %q must be of the form name=value", line, option)
+				}
+				entry.Options = append(entry.Options, APTOption{Name: parts[0], Value: parts[1]})
+			}
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: a source must have a URI and a suite", line)
+		}
+		entry.Suites = []string{fields[1]}
+		entry.Components = fields[2:]
+		sources = append(sources, aptSource{uri: fields[0], entry: entry})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return aptUpstreams(listFile, sources, opts)
+}
+
+// LoadAPTSourcesUpstreams loads the stanzas of a deb822 .sources file.
+func LoadAPTSourcesUpstreams(sourcesFile string, opts LoadOptions) ([]Upstream, error) {
+	f, err := os.Open(sourcesFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var sources []aptSource
+	var stanzas []map[string]string
+	var stanza map[string]string
+	var lastField string
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		switch {
+		case strings.HasPrefix(text, "#"):
+			continue
+		case len(strings.TrimSpace(text)) == 0:
+			stanza, lastField = nil, ""
+			continue
+		case text[0] == ' ' || text[0] == '\t':
+			if len(lastField) == 0 {
+				return nil, fmt.Errorf("line %d: continuation line without a field", line)
+			}
+			value := strings.TrimSpace(text)
+			if value == "." {
+				value = ""
+			}
+			stanza[lastField] += "\n" + value
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected a field of the form Name: value", line)
+		}
+		if stanza == nil {
+			stanza = make(map[string]string)
+			stanzas = append(stanzas, stanza)
+		}
+		lastField = strings.ToLower(strings.TrimSpace(parts[0]))
+		stanza[lastField] = strings.TrimSpace(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, stanza := range stanzas {
+		if enabled, ok := stanza["enabled"]; ok && strings.ToLower(enabled) == "no" {
+			continue
+		}
+		entry := APTEntry{
+			Types:      strings.Fields(stanza["types"]),
+			Suites:     strings.Fields(stanza["suites"]),
+			Components: strings.Fields(stanza["components"]),
+		}
+		uris := strings.Fields(stanza["uris"])
+		if len(entry.Types) == 0 || len(uris) == 0 || len(entry.Suites) == 0 {
+			return nil, fmt.Errorf("stanza %d: Types, URIs and Suites are required", i+1)
+		}
+		for name, field := range aptOptionFields {
+			if value, ok := stanza[strings.ToLower(field)]; ok {
+				entry.Options = append(entry.Options, APTOption{Name: name, Value: strings.TrimPrefix(value, "\n")})
+			}
+		}
+		sort.Slice(entry.Options, func(i, j int) bool { return entry.Options[i].Name < entry.Options[j].Name })
+		for _, uri := range uris {
+			sources = append(sources, aptSource{uri: uri, entry: entry})
+		}
+	}
+	return aptUpstreams(sourcesFile, sources, opts)
+}
+
+// aptUpstreams creates one upstream for each distinct URI in sources. The
+// first is named after the file and the remainder are suffixed with their
+// position in the file.
+func aptUpstreams(file string, sources []aptSource, opts LoadOptions) ([]Upstream, error) {
+	base := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	var upstreams []Upstream
+	byURI := make(map[string]int)
+	for _, source := range sources {
+		u, err := url.Parse(source.uri)
+		if err != nil {
+			return nil, fmt.Errorf("the URI %s is not valid: %v", source.uri, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			log.Printf("warn: APT source %s in %s will be ignored, only http and https are supported", source.uri, file)
+			continue
+		}
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		key := u.String()
+		if i, ok := byURI[key]; ok {
+			upstreams[i].APT = append(upstreams[i].APT, source.entry)
+			continue
+		}
+
+		name := base
+		if len(upstreams) > 0 {
+			name = fmt.Sprintf("%s-%d", base, len(upstreams))
+		}
+		upstream := chainOrigins(UpstreamTypeAPT, []Upstream{newOrigin(name, u, opts)})
+		upstream.Repo = true
+		upstream.APT = []APTEntry{source.entry}
+		if suite := source.entry.Suites[0]; strings.HasSuffix(suite, "/") {
+			upstream.HealthPath = strings.TrimPrefix(suite, "./") + "Release"
+		} else {
+			upstream.HealthPath = "dists/" + suite + "/Release"
+		}
+		byURI[key] = len(upstreams)
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams, nil
+}
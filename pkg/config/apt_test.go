@@ -0,0 +1,264 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeFile writes data to a file named name in a new temporary directory and
+// returns its path.
+func writeFile(t *testing.T, name, data string) string {
+	dir, err := ioutil.TempDir("", "content-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path
+}
+
+// aptSummary is the part of an APT upstream the tests compare.
+type aptSummary struct {
+	Name       string
+	Origin     string
+	HealthPath string
+	APT        []APTEntry
+}
+
+func summarizeAPT(upstreams []Upstream) []aptSummary {
+	var summaries []aptSummary
+	for _, u := range upstreams {
+		summaries = append(summaries, aptSummary{Name: u.Name, Origin: u.Origin, HealthPath: u.HealthPath, APT: u.APT})
+	}
+	return summaries
+}
+
+func TestLoadAPTSourcesUpstreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []aptSummary
+		wantErr bool
+	}{
+		{
+			name: "one upstream per URI",
+			data: `# the main archive
+Types: deb deb-src
+URIs: http://deb.example.com/debian https://security.example.com/debian-security/
+Suites: bookworm bookworm-updates
+Components: main contrib
+`,
+			want: []aptSummary{
+				{
+					Name:       "debian",
+					Origin:     "http://deb.example.com/debian/",
+					HealthPath: "dists/bookworm/Release",
+					APT: []APTEntry{{
+						Types:      []string{"deb", "deb-src"},
+						Suites:     []string{"bookworm", "bookworm-updates"},
+						Components: []string{"main", "contrib"},
+					}},
+				},
+				{
+					Name:       "debian-1",
+					Origin:     "https://security.example.com/debian-security/",
+					HealthPath: "dists/bookworm/Release",
+					APT: []APTEntry{{
+						Types:      []string{"deb", "deb-src"},
+						Suites:     []string{"bookworm", "bookworm-updates"},
+						Components: []string{"main", "contrib"},
+					}},
+				},
+			},
+		},
+		{
+			name: "stanzas for the same URI share an upstream",
+			data: `Types: deb
+URIs: http://deb.example.com/debian/
+Suites: bookworm
+Components: main
+
+Types: deb
+URIs: http://deb.example.com/debian
+Suites: bookworm-backports
+Components: main
+Architectures: amd64 arm64
+`,
+			want: []aptSummary{{
+				Name:       "debian",
+				Origin:     "http://deb.example.com/debian/",
+				HealthPath: "dists/bookworm/Release",
+				APT: []APTEntry{
+					{Types: []string{"deb"}, Suites: []string{"bookworm"}, Components: []string{"main"}},
+					{
+						Types:      []string{"deb"},
+						Suites:     []string{"bookworm-backports"},
+						Components: []string{"main"},
+						Options:    []APTOption{{Name: "arch", Value: "amd64 arm64"}},
+					},
+				},
+			}},
+		},
+		{
+			name: "fields are case insensitive and disabled stanzas are skipped",
+			data: `types: deb
+uris: http://deb.example.com/debian
+suites: bookworm
+enabled: yes
+components: main
+
+Types: deb
+URIs: http://disabled.example.com/debian
+Suites: bookworm
+Enabled: no
+`,
+			want: []aptSummary{{
+				Name:       "debian",
+				Origin:     "http://deb.example.com/debian/",
+				HealthPath: "dists/bookworm/Release",
+				APT:        []APTEntry{{Types: []string{"deb"}, Suites: []string{"bookworm"}, Components: []string{"main"}}},
+			}},
+		},
+		{
+			name: "options are sorted and inline keys keep their lines",
+			data: `Types: deb
+URIs: http://deb.example.com/debian
+Suites: bookworm
+Components: main
+Trusted: no
+Signed-By:
+ -----BEGIN PGP PUBLIC KEY BLOCK-----
+ .
+ mQINBF
+ -----END PGP PUBLIC KEY BLOCK-----
+`,
+			want: []aptSummary{{
+				Name:       "debian",
+				Origin:     "http://deb.example.com/debian/",
+				HealthPath: "dists/bookworm/Release",
+				APT: []APTEntry{{
+					Types:      []string{"deb"},
+					Suites:     []string{"bookworm"},
+					Components: []string{"main"},
+					Options: []APTOption{
+						{Name: "signed-by", Value: "-----BEGIN PGP PUBLIC KEY BLOCK-----\n\nmQINBF\n-----END PGP PUBLIC KEY BLOCK-----"},
+						{Name: "trusted", Value: "no"},
+					},
+				}},
+			}},
+		},
+		{
+			name: "flat repositories are checked at the suite",
+			data: `Types: deb
+URIs: http://deb.example.com/flat
+Suites: ./
+`,
+			want: []aptSummary{{
+				Name:       "debian",
+				Origin:     "http://deb.example.com/flat/",
+				HealthPath: "Release",
+				APT:        []APTEntry{{Types: []string{"deb"}, Suites: []string{"./"}, Components: []string{}}},
+			}},
+		},
+		{
+			name: "only http and https are mirrored",
+			data: `Types: deb
+URIs: file:///srv/debian cdrom:/media/cdrom/ http://deb.example.com/debian
+Suites: bookworm
+`,
+			want: []aptSummary{{
+				Name:       "debian",
+				Origin:     "http://deb.example.com/debian/",
+				HealthPath: "dists/bookworm/Release",
+				APT:        []APTEntry{{Types: []string{"deb"}, Suites: []string{"bookworm"}, Components: []string{}}},
+			}},
+		},
+		{name: "empty", data: "# nothing\n", want: nil},
+		{name: "missing suites", data: "Types: deb\nURIs: http://deb.example.com/debian\n", wantErr: true},
+		{name: "missing URIs", data: "Types: deb\nSuites: bookworm\n", wantErr: true},
+		{name: "continuation without a field", data: " bookworm\nTypes: deb\n", wantErr: true},
+		{name: "line without a field name", data: "Types: deb\nbookworm\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, "debian.sources", tt.data)
+			defer os.RemoveAll(filepath.Dir(path))
+			upstreams, err := LoadAPTSourcesUpstreams(path, LoadOptions{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := summarizeAPT(upstreams); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%#v\nwant\n%#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadAPTListUpstreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []aptSummary
+		wantErr bool
+	}{
+		{
+			name: "entries with and without options",
+			data: `deb http://deb.example.com/debian bookworm main contrib # comment
+deb-src [ arch=amd64 signed-by=/usr/share/keyrings/debian.gpg ] http://deb.example.com/debian bookworm main
+deb [trusted=yes] https://other.example.com/repo stable
+`,
+			want: []aptSummary{
+				{
+					Name:       "sources",
+					Origin:     "http://deb.example.com/debian/",
+					HealthPath: "dists/bookworm/Release",
+					APT: []APTEntry{
+						{Types: []string{"deb"}, Suites: []string{"bookworm"}, Components: []string{"main", "contrib"}},
+						{
+							Types:      []string{"deb-src"},
+							Suites:     []string{"bookworm"},
+							Components: []string{"main"},
+							Options: []APTOption{
+								{Name: "arch", Value: "amd64"},
+								{Name: "signed-by", Value: "/usr/share/keyrings/debian.gpg"},
+							},
+						},
+					},
+				},
+				{
+					Name:       "sources-1",
+					Origin:     "https://other.example.com/repo/",
+					HealthPath: "dists/stable/Release",
+					APT: []APTEntry{{
+						Types:      []string{"deb"},
+						Suites:     []string{"stable"},
+						Components: []string{},
+						Options:    []APTOption{{Name: "trusted", Value: "yes"}},
+					}},
+				},
+			},
+		},
+		{name: "unknown type", data: "rpm http://deb.example.com/debian bookworm\n", wantErr: true},
+		{name: "missing suite", data: "deb http://deb.example.com/debian\n", wantErr: true},
+		{name: "option without a value", data: "deb [trusted] http://deb.example.com/debian bookworm\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, "sources.list", tt.data)
+			defer os.RemoveAll(filepath.Dir(path))
+			upstreams, err := LoadAPTListUpstreams(path, LoadOptions{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := summarizeAPT(upstreams); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%#v\nwant\n%#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// CacheRule controls how responses for paths, relative to the upstream, that
+// match Pattern are cached. The rule of an upstream that applies to every
+// path has no Pattern.
+type CacheRule struct {
+	Pattern string
+	// Description is included in the generated configuration.
+	Description string
+
+	// TTL is how long successful responses are cached, as an nginx time
+	// such as 5m. If empty the global default applies.
+	TTL string
+	// NegativeTTL is how long 404 and 410 responses are cached. They are
+	// not cached if empty.
+	NegativeTTL string
+	// Stale lists the conditions under which a stale response is served,
+	// as accepted by proxy_cache_use_stale. If empty the global policy
+	// applies.
+	Stale []string
+	// NoCache prevents responses from being cached.
+	NoCache bool
+	// VaryOnAccept caches responses separately for each Accept header.
+	VaryOnAccept bool
+}
+
+var (
+	// nginxTimePattern matches an nginx time interval.
+	nginxTimePattern = regexp.MustCompile(`^[0-9]+(ms|s|m|h|d|w|M|y)?$`)
+	// staleConditions are the values accepted by proxy_cache_use_stale.
+	staleConditions = map[string]struct{}{
+		"error": {}, "timeout": {}, "invalid_header": {}, "updating": {},
+		"http_500": {}, "http_502": {}, "http_503": {}, "http_504": {},
+		"http_403": {}, "http_404": {}, "http_429": {}, "off": {},
+	}
+)
+
+// ParseCacheRule parses a rule of the form
+//
+//	PATTERN [ttl=TIME] [negative=TIME] [stale=COND,...] [nocache] [vary=accept]
+//
+// where PATTERN is a regular expression that must match the whole path
+// relative to the upstream, such as .*\.json or repodata/.*
+func ParseCacheRule(s string) (CacheRule, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return CacheRule{}, fmt.Errorf("a cache rule requires a path pattern")
+	}
+	rule := CacheRule{Pattern: fields[0]}
+	for _, field := range fields[1:] {
+		parts := strings.SplitN(field, "=", 2)
+		switch {
+		case field == "nocache":
+			rule.NoCache = true
+		case len(parts) != 2:
+			return CacheRule{}, fmt.Errorf("unrecognized cache rule option %q", field)
+		case parts[0] == "ttl":
+			rule.TTL = parts[1]
+		case parts[0] == "negative":
+			rule.NegativeTTL = parts[1]
+		case parts[0] == "stale":
+			rule.Stale = strings.Split(parts[1], ",")
+		case parts[0] == "vary":
+			if parts[1] != "accept" {
+				return CacheRule{}, fmt.Errorf("only vary=accept is supported")
+			}
+			rule.VaryOnAccept = true
+		default:
+			return CacheRule{}, fmt.Errorf("unrecognized cache rule option %q", field)
+		}
+	}
+	if err := rule.Validate(); err != nil {
+		return CacheRule{}, err
+	}
+	return rule, nil
+}
+
+// Validate returns an error if the rule cannot be rendered.
+func (r CacheRule) Validate() error {
+	if len(r.Pattern) == 0 {
+		return fmt.Errorf("a cache rule requires a path pattern")
+	}
+	if _, err := regexp.Compile(r.Pattern); err != nil || strings.ContainsAny(r.Pattern, "\"\n") {
+		return fmt.Errorf("the path pattern %q must be a regular expression without quotes", r.Pattern)
+	}
+	if len(r.TTL) == 0 && !r.NoCache {
+		return fmt.Errorf("a ttl is required unless the rule is nocache")
+	}
+	for _, t := range []string{r.TTL, r.NegativeTTL} {
+		if len(t) > 0 && !nginxTimePattern.MatchString(t) {
+			return fmt.Errorf("%q must be a time such as 30s, 5m or 7d", t)
+		}
+	}
+	for _, condition := range r.Stale {
+		if _, ok := staleConditions[condition]; !ok {
+			return fmt.Errorf("%q is not a stale condition, must be one of error, timeout, invalid_header, updating, http_500, http_502, http_503, http_504, http_403, http_404, http_429 or off", condition)
+		}
+	}
+	return nil
+}
+
+// builtinCacheRules are the rules of each type of upstream. Cache applies to
+// paths that match none of the Rules.
+var builtinCacheRules = map[UpstreamType]struct {
+	Cache CacheRule
+	Rules []CacheRule
+}{
+	UpstreamTypeRPM: {
+		Rules: []CacheRule{
+			{
+				Pattern:     `(?:.*/)?repodata/repomd\.xml`,
+				Description: "When a yum repository is rebuilt, references in an old copy of repomd.xml will no longer resolve",
+				TTL:         "60s",
+			},
+		},
+	},
+	UpstreamTypeAPT: {
+		Rules: []CacheRule{
+			{
+				Pattern:     `.*/by-hash/.*`,
+				Description: "Indices under by-hash are named by their checksum and never change",
+				TTL:         "30d",
+			},
+			{
+				Pattern:     `(?:dists/.*)|(?:.*/)?(?:InRelease|Release(?:\.gpg)?|Packages[^/]*|Sources[^/]*)`,
+				Description: "Release files and the indices they reference are replaced whenever the archive is updated",
+				TTL:         "60s",
+			},
+		},
+	},
+	UpstreamTypePyPI: {
+		Cache: CacheRule{
+			Description:  "Index pages change whenever a project is released, and their format depends on what the client accepts",
+			TTL:          "5m",
+			VaryOnAccept: true,
+		},
+	},
+	UpstreamTypePyPIFiles: {
+		Cache: CacheRule{Description: "Package files are never replaced once they are published", TTL: "30d"},
+	},
+	UpstreamTypeNPM: {
+		Cache: CacheRule{
+			Description:  "Package metadata changes whenever a version is published, clients may request the abbreviated form",
+			TTL:          "60s",
+			VaryOnAccept: true,
+		},
+		Rules: []CacheRule{
+			{Pattern: `.+/-/[^/]+\.tgz`, Description: "Tarballs are never replaced once they are published", TTL: "30d"},
+		},
+	},
+	UpstreamTypeGoProxy: {
+		Cache: CacheRule{Description: "Version lists and queries change whenever a module is tagged", TTL: "60s"},
+		Rules: []CacheRule{
+			{
+				Pattern:     `.+/@v/v[0-9]+\.[0-9]+\.[0-9]+[^/]*\.(?:info|mod|zip)`,
+				Description: "The info, go.mod and zip of a version never change",
+				TTL:         "30d",
+			},
+		},
+	},
+	UpstreamTypeGoSumDB: {
+		Cache: CacheRule{Description: "The latest signed tree head and lookups that include it change as modules are added", TTL: "60s"},
+		Rules: []CacheRule{
+			{Pattern: `tile/[^.]+`, Description: "Full tiles never change, only partial tiles (ending in .p/W) grow", TTL: "30d"},
+		},
+	},
+	UpstreamTypeMaven: {
+		Cache: CacheRule{Description: "Released artifacts and their checksums are never replaced", TTL: "30d"},
+		Rules: []CacheRule{
+			{
+				Pattern:     `.*/maven-metadata\.xml(?:\.[a-z0-9]+)?|.*-SNAPSHOT/.*`,
+				Description: "Metadata and snapshots change whenever something is deployed",
+				TTL:         "60s",
+			},
+		},
+	},
+	UpstreamTypeAPK: {
+		Cache: CacheRule{Description: "Packages are never replaced once they are published", TTL: "30d"},
+		Rules: []CacheRule{
+			{
+				Pattern:     `(?:.*/)?APKINDEX\.tar\.gz`,
+				Description: "The index of each architecture is replaced whenever a package is published",
+				TTL:         "60s",
+			},
+		},
+	},
+	UpstreamTypeHelm: {
+		Cache: CacheRule{Description: "Chart versions are never replaced once they are published", TTL: "30d"},
+	},
+}
+
+// applyCacheRules sets the cache rules of every origin to its own rules,
+// followed by the global rules and the built-in rules of its type. Registries
+// are cached by digest and ignore cache rules.
+func applyCacheRules(upstreams []Upstream, global []CacheRule) []Upstream {
+	apply := func(origin Upstream) Upstream {
+		builtin := builtinCacheRules[origin.Type]
+		var rules []CacheRule
+		rules = append(rules, origin.CacheRules...)
+		rules = append(rules, global...)
+		rules = append(rules, builtin.Rules...)
+		origin.CacheRules = rules
+		if len(origin.Cache.TTL) == 0 && !origin.Cache.NoCache {
+			origin.Cache = builtin.Cache
+		}
+		// a cached 404 would hide the content of the remaining mirrors,
+		// which share the cache
+		if len(origin.Fallback) > 0 {
+			origin.Cache.NegativeTTL = ""
+			for i := range origin.CacheRules {
+				origin.CacheRules[i].NegativeTTL = ""
+			}
+		}
+		return origin
+	}
+	for i := range upstreams {
+		if upstreams[i].Type == UpstreamTypeRegistry {
+			continue
+		}
+		upstreams[i] = apply(upstreams[i])
+		for j := range upstreams[i].Mirrors {
+			upstreams[i].Mirrors[j] = apply(upstreams[i].Mirrors[j])
+		}
+	}
+	return upstreams
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCacheRule(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    CacheRule
+		wantErr bool
+	}{
+		{in: `repodata/.* ttl=60s`, want: CacheRule{Pattern: `repodata/.*`, TTL: "60s"}},
+		{
+			in:   `  .*\.json   ttl=5m negative=30s stale=error,timeout,updating vary=accept `,
+			want: CacheRule{Pattern: `.*\.json`, TTL: "5m", NegativeTTL: "30s", Stale: []string{"error", "timeout", "updating"}, VaryOnAccept: true},
+		},
+		{in: `.*/latest nocache`, want: CacheRule{Pattern: `.*/latest`, NoCache: true}},
+		{in: `.* nocache ttl=1d`, want: CacheRule{Pattern: `.*`, TTL: "1d", NoCache: true}},
+		{in: `.* ttl=500ms`, want: CacheRule{Pattern: `.*`, TTL: "500ms"}},
+		{in: `.* ttl=3600`, want: CacheRule{Pattern: `.*`, TTL: "3600"}},
+		{in: `.* ttl=1M stale=off`, want: CacheRule{Pattern: `.*`, TTL: "1M", Stale: []string{"off"}}},
+
+		{in: ``, wantErr: true},
+		{in: `   `, wantErr: true},
+		// a ttl is required unless responses are not cached
+		{in: `.*`, wantErr: true},
+		{in: `.* negative=1m`, wantErr: true},
+		{in: `.* ttl=`, wantErr: true},
+		{in: `.* ttl=5 m`, wantErr: true},
+		{in: `.* ttl=5min`, wantErr: true},
+		{in: `.* ttl=-5m`, wantErr: true},
+		{in: `.* ttl=5m negative=soon`, wantErr: true},
+		{in: `.* ttl=5m stale=error,http_418`, wantErr: true},
+		{in: `.* ttl=5m stale=`, wantErr: true},
+		{in: `.* ttl=5m vary=cookie`, wantErr: true},
+		{in: `.* ttl=5m immutable`, wantErr: true},
+		{in: `.* ttl=5m max=1h`, wantErr: true},
+		{in: `[ ttl=5m`, wantErr: true},
+		{in: `(unclosed ttl=5m`, wantErr: true},
+		{in: `"quoted" ttl=5m`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCacheRule(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseCacheRule(%q): unexpected error: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseCacheRule(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// definitionsFileV1 is version 1 of the schema of .yaml and .json upstream
+// definition files:
+//
+//	version: 1
+//	upstreams:
+//	- name: tools
+//	  type: generic            # or rpm
+//	  urls:                    # tried in order
+//	  - https://tools.example.com/dist/
+//	  hosts: [10.0.0.1:443]    # optional, servers to connect to for a single URL
+//	  tls:
+//	    verify: true
+//	    caCertificate: ca.crt
+//	    clientCertificate: client.crt
+//	    clientKey: client.key
+//	    serverName: tools.example.com
+//	  auth: {username: user, password: secret}
+//	  proxy: {url: http://proxy:3128, username: user, password: secret}
+//	  headers:
+//	    X-Api-Key: secret
+//	  cache:                   # the first rule that matches the path wins
+//	  - path: '.*\.json'
+//	    ttl: 5m
+//	    negativeTTL: 1m        # cache 404s, only from the last URL
+//	    stale: [error, timeout, updating]
+//	  - path: 'nightly/.*'
+//	    cache: false
+//	  - path: 'rules/.*'       # or a rule in the form accepted by --cache-rule
+//	    rule: 'ttl=1h vary=accept'
+//	  healthPath: index.html
+//	  publish: true            # publish a client configuration
+type definitionsFileV1 struct {
+	Version   int            `json:"version" yaml:"version"`
+	Upstreams []definitionV1 `json:"upstreams" yaml:"upstreams"`
+}
+
+type definitionV1 struct {
+	Name       string            `json:"name" yaml:"name"`
+	Type       string            `json:"type" yaml:"type"`
+	URLs       []string          `json:"urls" yaml:"urls"`
+	Hosts      []string          `json:"hosts" yaml:"hosts"`
+	TLS        *tlsV1            `json:"tls" yaml:"tls"`
+	Auth       *credentialsV1    `json:"auth" yaml:"auth"`
+	Proxy      *proxyV1          `json:"proxy" yaml:"proxy"`
+	Headers    map[string]string `json:"headers" yaml:"headers"`
+	Cache      []cacheRuleV1     `json:"cache" yaml:"cache"`
+	HealthPath string            `json:"healthPath" yaml:"healthPath"`
+	Publish    bool              `json:"publish" yaml:"publish"`
+	Labels     map[string]string `json:"labels" yaml:"labels"`
+}
+
+type tlsV1 struct {
+	Verify            *bool  `json:"verify" yaml:"verify"`
+	CACertificate     string `json:"caCertificate" yaml:"caCertificate"`
+	ClientCertificate string `json:"clientCertificate" yaml:"clientCertificate"`
+	ClientKey         string `json:"clientKey" yaml:"clientKey"`
+	ServerName        string `json:"serverName" yaml:"serverName"`
+}
+
+type credentialsV1 struct {
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+}
+
+type proxyV1 struct {
+	URL      string `json:"url" yaml:"url"`
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+}
+
+type cacheRuleV1 struct {
+	Path         string   `json:"path" yaml:"path"`
+	TTL          string   `json:"ttl" yaml:"ttl"`
+	NegativeTTL  string   `json:"negativeTTL" yaml:"negativeTTL"`
+	Stale        []string `json:"stale" yaml:"stale"`
+	Cache        *bool    `json:"cache" yaml:"cache"`
+	VaryOnAccept bool     `json:"varyOnAccept" yaml:"varyOnAccept"`
+	Rule         string   `json:"rule" yaml:"rule"`
+}
+
+// headerNamePattern matches an HTTP header name.
+var headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// LoadUpstreamDefinitions loads the upstreams defined in a .yaml or .json
+// file. Errors in the syntax of the file include the line they occurred on.
+func LoadUpstreamDefinitions(definitionsFile string, data []byte, opts LoadOptions) ([]Upstream, error) {
+	isJSON := filepath.Ext(definitionsFile) == ".json"
+
+	var version struct {
+		Version int `json:"version" yaml:"version"`
+	}
+	if err := decodeDefinitions(data, isJSON, false, &version); err != nil {
+		return nil, err
+	}
+	switch version.Version {
+	case 1:
+	case 0:
+		return nil, fmt.Errorf("version is required")
+	default:
+		return nil, fmt.Errorf("version %d is not supported", version.Version)
+	}
+
+	var file definitionsFileV1
+	if err := decodeDefinitions(data, isJSON, true, &file); err != nil {
+		return nil, err
+	}
+	var upstreams []Upstream
+	for i, def := range file.Upstreams {
+		upstream, err := def.upstream(definitionsFile, opts)
+		if err != nil {
+			if len(def.Name) > 0 {
+				return nil, &SectionError{Section: def.Name, Err: err}
+			}
+			return nil, &SectionError{Section: fmt.Sprintf("upstreams[%d]", i), Err: err}
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams, nil
+}
+
+// decodeDefinitions decodes data into out, rejecting unknown fields if strict
+// is set.
+func decodeDefinitions(data []byte, isJSON, strict bool, out interface{}) error {
+	if !isJSON {
+		if strict {
+			return yaml.UnmarshalStrict(data, out)
+		}
+		return yaml.Unmarshal(data, out)
+	}
+	err := json.Unmarshal(data, out)
+	switch t := err.(type) {
+	case *json.SyntaxError:
+		return fmt.Errorf("line %d: %v", lineAt(data, t.Offset), err)
+	case *json.UnmarshalTypeError:
+		return fmt.Errorf("line %d: %v", lineAt(data, t.Offset), err)
+	case nil:
+	default:
+		return err
+	}
+	if !strict {
+		return nil
+	}
+	// the decoder only rejects unknown fields itself from Go 1.10
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	if field := unknownField(value, reflect.TypeOf(out), ""); len(field) > 0 {
+		return fmt.Errorf("json: unknown field %q", field)
+	}
+	return nil
+}
+
+// unknownField returns the path of the first key in value that is not a
+// field of t, which is matched without regard to case as encoding/json does,
+// or an empty string if every key is a field.
+func unknownField(value interface{}, t reflect.Type, path string) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if len(name) == 0 {
+				name = field.Name
+			}
+			fields[strings.ToLower(name)] = field.Type
+		}
+		for key, v := range object {
+			fieldType, ok := fields[strings.ToLower(key)]
+			if !ok {
+				return joinFieldPath(path, key)
+			}
+			if unknown := unknownField(v, fieldType, joinFieldPath(path, key)); len(unknown) > 0 {
+				return unknown
+			}
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		for key, v := range object {
+			if unknown := unknownField(v, t.Elem(), joinFieldPath(path, key)); len(unknown) > 0 {
+				return unknown
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		items, ok := value.([]interface{})
+		if !ok {
+			return ""
+		}
+		for i, v := range items {
+			if unknown := unknownField(v, t.Elem(), fmt.Sprintf("%s[%d]", path, i)); len(unknown) > 0 {
+				return unknown
+			}
+		}
+	}
+	return ""
+}
+
+func joinFieldPath(path, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
+
+// lineAt returns the line of data that offset is on.
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+func (d definitionV1) upstream(file string, opts LoadOptions) (Upstream, error) {
+	if len(d.Name) == 0 {
+		return Upstream{}, fmt.Errorf("name is required")
+	}
+	var upstreamType UpstreamType
+	switch UpstreamType(d.Type) {
+	case "", UpstreamTypeGeneric:
+		upstreamType = UpstreamTypeGeneric
+	case UpstreamTypeRPM:
+		upstreamType = UpstreamTypeRPM
+	default:
+		return Upstream{}, fmt.Errorf("type %q is not supported, must be generic or rpm", d.Type)
+	}
+	if len(d.URLs) == 0 {
+		return Upstream{}, fmt.Errorf("at least one URL is required")
+	}
+	if len(d.Hosts) > 0 && len(d.URLs) > 1 {
+		return Upstream{}, fmt.Errorf("hosts may only be set with a single URL")
+	}
+	for _, host := range d.Hosts {
+		if len(host) == 0 || strings.ContainsAny(host, " \t;{}\"'") {
+			return Upstream{}, fmt.Errorf("host %q must be a host or host:port", host)
+		}
+	}
+
+	settings := originSettings{SSLVerify: true}
+	var serverName string
+	if d.TLS != nil {
+		if d.TLS.Verify != nil {
+			settings.SSLVerify = *d.TLS.Verify
+		}
+		settings.CACertificatePath = makePathRelativeToFile(file, d.TLS.CACertificate)
+		settings.ClientCertificate = makePathRelativeToFile(file, d.TLS.ClientCertificate)
+		settings.ClientCertificateKey = makePathRelativeToFile(file, d.TLS.ClientKey)
+		serverName = d.TLS.ServerName
+	}
+	if d.Auth != nil {
+		settings.Username, settings.Password = d.Auth.Username, d.Auth.Password
+	}
+	if d.Proxy != nil {
+		settings.Proxy, settings.ProxyUsername, settings.ProxyPassword = d.Proxy.URL, d.Proxy.Username, d.Proxy.Password
+	}
+
+	var headers []Header
+	for name, value := range d.Headers {
+		if !headerNamePattern.MatchString(name) {
+			return Upstream{}, fmt.Errorf("header %q is not a valid header name", name)
+		}
+		if strings.ContainsAny(value, "\"\\$") || strings.IndexFunc(value, isControl) != -1 {
+			return Upstream{}, fmt.Errorf("header %s may not contain quotes, backslashes, $ or control characters", name)
+		}
+		headers = append(headers, Header{Name: http.CanonicalHeaderKey(name), Value: value})
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+
+	for key, value := range d.Labels {
+		if err := validateLabel(key, value); err != nil {
+			return Upstream{}, err
+		}
+	}
+
+	var rules []CacheRule
+	for i, rule := range d.Cache {
+		cacheRule, err := rule.cacheRule()
+		if err != nil {
+			return Upstream{}, fmt.Errorf("cache[%d]: %v", i, err)
+		}
+		rules = append(rules, cacheRule)
+	}
+
+	var origins []Upstream
+	for i, rawURL := range d.URLs {
+		u, err := url.Parse(strings.TrimSpace(rawURL))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return Upstream{}, fmt.Errorf("%s is not a valid http or https URL", rawURL)
+		}
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		origin := newOrigin(mirrorName(d.Name, i), u, opts)
+		if err := configureOrigin(&origin, settings, opts); err != nil {
+			return Upstream{}, err
+		}
+		if len(serverName) > 0 && origin.TLS {
+			origin.ServerName = serverName
+		}
+		if len(d.Hosts) > 0 {
+			origin.HostHeader = origin.Hosts[0]
+			origin.Hosts = d.Hosts
+		}
+		origin.Headers = headers
+		origin.CacheRules = rules
+		origins = append(origins, origin)
+	}
+	upstream := chainOrigins(upstreamType, origins)
+	upstream.Repo = d.Publish
+	upstream.HealthPath = strings.TrimPrefix(d.HealthPath, "/")
+	if len(d.Labels) > 0 {
+		upstream.Labels = d.Labels
+	}
+	return upstream, nil
+}
+
+func (r cacheRuleV1) cacheRule() (CacheRule, error) {
+	if len(r.Rule) > 0 {
+		if len(r.TTL) > 0 || len(r.NegativeTTL) > 0 || len(r.Stale) > 0 || r.Cache != nil || r.VaryOnAccept {
+			return CacheRule{}, fmt.Errorf("rule may not be combined with other settings")
+		}
+		if strings.ContainsAny(r.Path, " \t") {
+			return CacheRule{}, fmt.Errorf("path may not contain whitespace when rule is set")
+		}
+		return ParseCacheRule(r.Path + " " + r.Rule)
+	}
+	rule := CacheRule{
+		Pattern:      r.Path,
+		TTL:          r.TTL,
+		NegativeTTL:  r.NegativeTTL,
+		Stale:        r.Stale,
+		NoCache:      r.Cache != nil && !*r.Cache,
+		VaryOnAccept: r.VaryOnAccept,
+	}
+	if err := rule.Validate(); err != nil {
+		return CacheRule{}, err
+	}
+	return rule, nil
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// FrontendHeader is set by nginx on requests to the local server to the name
+// of the frontend the request was received by.
+const FrontendHeader = "X-Content-Mirror-Frontend"
+
+var (
+	// labelPattern matches label keys and values.
+	labelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+	// serverNamePattern matches the names accepted by server_name, which
+	// may start or end with a wildcard.
+	serverNamePattern = regexp.MustCompile(`^(\*\.)?[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*(\.\*)?$`)
+)
+
+// ParseLabels parses labels of the form key=value.
+func ParseLabels(labels []string) (map[string]string, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	parsed := make(map[string]string)
+	for _, label := range labels {
+		if len(label) == 0 {
+			continue
+		}
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("the label %q must be of the form key=value", label)
+		}
+		if err := validateLabel(parts[0], parts[1]); err != nil {
+			return nil, err
+		}
+		parsed[parts[0]] = parts[1]
+	}
+	return parsed, nil
+}
+
+func validateLabel(key, value string) error {
+	if !labelPattern.MatchString(key) || !labelPattern.MatchString(value) {
+		return fmt.Errorf("the label %s=%s may only contain letters, digits, '.', '_', '/' and '-'", key, value)
+	}
+	return nil
+}
+
+// Validate returns an error if the frontend cannot be rendered.
+func (f Frontend) Validate() error {
+	if !namePattern.MatchString(f.Name) {
+		return fmt.Errorf("the frontend name %q must contain only letters, digits, '.', '_' and '-'", f.Name)
+	}
+	if len(f.Listen) == 0 || strings.ContainsAny(f.Listen, " \t;{}\"'") {
+		return fmt.Errorf("the frontend %s must listen on a port, host or host:port", f.Name)
+	}
+	for _, name := range f.ServerNames {
+		if !serverNamePattern.MatchString(name) {
+			return fmt.Errorf("the server name %q of frontend %s must be a host name", name, f.Name)
+		}
+	}
+	for _, selector := range f.Upstreams {
+		_, err := path.Match(selectorPattern(selector), "")
+		if parts := strings.SplitN(selector, "=", 2); len(parts) == 2 && !labelPattern.MatchString(parts[0]) {
+			err = fmt.Errorf("invalid label")
+		}
+		if err != nil || len(selectorPattern(selector)) == 0 {
+			return fmt.Errorf("the upstream selector %q of frontend %s must be a name, a glob or key=value", selector, f.Name)
+		}
+	}
+	return nil
+}
+
+// Selects returns true if the frontend serves the upstream.
+func (f Frontend) Selects(upstream Upstream) bool {
+	if len(f.Upstreams) == 0 {
+		return true
+	}
+	for _, selector := range f.Upstreams {
+		if parts := strings.SplitN(selector, "=", 2); len(parts) == 2 {
+			value, ok := upstream.Labels[parts[0]]
+			if matched, _ := path.Match(parts[1], value); ok && matched {
+				return true
+			}
+			continue
+		}
+		if matched, _ := path.Match(strings.ToLower(selector), strings.ToLower(upstream.Name)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// selectorPattern returns the glob of a selector.
+func selectorPattern(selector string) string {
+	if parts := strings.SplitN(selector, "=", 2); len(parts) == 2 {
+		return parts[1]
+	}
+	return selector
+}
+
+// Frontend returns the frontend with name.
+func (c CacheConfig) Frontend(name string) (Frontend, bool) {
+	for _, frontend := range c.Frontends {
+		if frontend.Name == name {
+			return frontend, true
+		}
+	}
+	return Frontend{}, false
+}
+
+// Exposed returns the configuration with only the upstreams the frontend
+// serves. Upstreams that a served upstream routes requests or rewrites links
+// to are also served.
+func (c CacheConfig) Exposed(f Frontend) CacheConfig {
+	if len(f.Upstreams) == 0 {
+		return c
+	}
+	selected := make(map[string]bool)
+	var pending []string
+	for _, upstream := range c.Upstreams {
+		if f.Selects(upstream) {
+			selected[upstream.Name] = true
+			pending = append(pending, upstream.Name)
+		}
+	}
+	byName := make(map[string]Upstream)
+	for _, upstream := range c.Upstreams {
+		byName[upstream.Name] = upstream
+	}
+	for len(pending) > 0 {
+		upstream := byName[pending[0]]
+		pending = pending[1:]
+		var references []string
+		for _, route := range upstream.Routes {
+			references = append(references, route.To)
+		}
+		for _, rewrite := range upstream.Rewrites {
+			references = append(references, rewrite.To)
+		}
+		for _, name := range references {
+			if _, ok := byName[name]; ok && !selected[name] {
+				selected[name] = true
+				pending = append(pending, name)
+			}
+		}
+	}
+
+	upstreams := make([]Upstream, 0, len(selected))
+	for _, upstream := range c.Upstreams {
+		if selected[upstream.Name] {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+	c.Upstreams = upstreams
+	return c
+}
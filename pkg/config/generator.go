@@ -5,20 +5,92 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"path"
 	"path/filepath"
 	"strings"
 	"sync"
 	"text/template"
+	"time"
 )
 
 type Generator struct {
 	configPath string
 	template   *template.Template
 	config     *CacheConfig
+	options    LoadOptions
+	validate   func(path string) error
 
-	lock       sync.Mutex
-	lastConfig *CacheConfig
+	lock sync.Mutex
+	// loadedConfig has been written to configPath and lastConfig is live.
+	loadedConfig *CacheConfig
+	lastConfig   *CacheConfig
+	lastError    *ValidationError
+	rejected     []RejectedInput
+	renamed      []RenamedUpstream
+}
+
+// RejectedInput is a configuration file, or a section of one, that was
+// ignored because it could not be loaded.
+type RejectedInput struct {
+	Path    string
+	Section string
+	Err     error
+}
+
+// SectionError is returned by loaders when a section of a file is not valid.
+type SectionError struct {
+	Section string
+	Err     error
+}
+
+func (e *SectionError) Error() string {
+	return fmt.Sprintf("section %s: %v", e.Section, e.Err)
+}
+
+// ValidationError is returned when a generated configuration is rejected. The
+// last valid configuration remains in place.
+type ValidationError struct {
+	Time time.Time
+	Err  error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("the generated configuration is not valid: %v", e.Err)
+}
+
+// LoadOptions controls how repository files are converted to upstreams.
+type LoadOptions struct {
+	// CABundlePath is the trust bundle used to verify upstreams that do not
+	// set their own CA. If empty, those upstreams cannot be verified.
+	CABundlePath string
+	// VerifyTLS controls whether https baseurls that do not use client
+	// certificates are verified. Repositories with client certificates
+	// always honor sslverify.
+	VerifyTLS bool
+
+	// Variables are substituted into base URLs. They are resolved from
+	// VariableDirs and Overrides each time configuration is loaded.
+	Variables Variables
+	// VariableDirs are dnf-style variable directories.
+	VariableDirs []string
+	// Overrides take precedence over variables from any other source.
+	Overrides Variables
+	// Architectures, if set, causes repositories whose base URL refers to
+	// $basearch to be mirrored once per architecture as <id>-<arch>.
+	Architectures []string
+
+	// Mirrors retrieves the contents of mirrorlist and metalink URLs. If
+	// nil, repositories without a baseurl are ignored.
+	Mirrors *MirrorResolver
+
+	// TunnelDir holds the unix sockets used to reach upstreams through a
+	// proxy.
+	TunnelDir string
+
+	// CacheRules apply to every upstream after its own rules and before the
+	// built-in rules of its type.
+	CacheRules []CacheRule
 }
 
 func NewGenerator(path string, template *template.Template, config *CacheConfig) *Generator {
@@ -29,62 +101,231 @@ func NewGenerator(path string, template *template.Template, config *CacheConfig)
 	}
 }
 
+// SetLoadOptions configures how repository files are loaded.
+func (m *Generator) SetLoadOptions(opts LoadOptions) {
+	m.options = opts
+}
+
+// SetValidator checks each generated configuration by invoking fn with the
+// path of a copy before it replaces the configuration file.
+func (m *Generator) SetValidator(fn func(path string) error) {
+	m.validate = fn
+}
+
+// Load generates the configuration for paths and applies it by writing it
+// to the configuration file, or logs it if there is no file.
 func (m *Generator) Load(paths []string) error {
 	log.Printf("Configuration inputs changed")
+	config, err := m.Generate(paths)
+	if err != nil {
+		return err
+	}
+	data, err := m.Render(config)
+	if err != nil {
+		return err
+	}
+	if len(m.configPath) == 0 {
+		// never log credentials
+		redacted, err := m.Render(config.Redacted())
+		if err != nil {
+			return err
+		}
+		log.Printf("template:\n%s", string(redacted))
+	} else {
+		if err := m.writeConfig(data); err != nil {
+			if verr, ok := err.(*ValidationError); ok {
+				m.lock.Lock()
+				m.lastError = verr
+				m.lock.Unlock()
+			}
+			return err
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.loadedConfig = &config
+	m.lastError = nil
+	return nil
+}
+
+// Generate loads the upstreams in paths and returns the configuration
+// without applying it. Inputs that are rejected or renamed are recorded.
+func (m *Generator) Generate(paths []string) (CacheConfig, error) {
+	opts := m.options
+	vars, err := ResolveVariables(opts.VariableDirs, opts.Overrides)
+	if err != nil {
+		return CacheConfig{}, err
+	}
+	opts.Variables = vars
+	if opts.Mirrors != nil {
+		opts.Mirrors.BeginLoad()
+		defer opts.Mirrors.EndLoad()
+	}
+
+	// inputs that cannot be loaded are skipped so the remaining upstreams
+	// continue to be served
 	var upstreams []Upstream
+	var rejected []RejectedInput
+	reject := func(path string, err error) {
+		rejection := RejectedInput{Path: path, Err: err}
+		if sectionErr, ok := err.(*SectionError); ok {
+			rejection.Section, rejection.Err = sectionErr.Section, sectionErr.Err
+		}
+		log.Printf("error: %s will be ignored: %v", path, err)
+		rejected = append(rejected, rejection)
+	}
 	for _, p := range paths {
 		files, err := ioutil.ReadDir(p)
 		if err != nil {
-			return err
+			reject(p, err)
+			continue
 		}
 		for _, file := range files {
 			if file.IsDir() {
 				continue
 			}
 			filePath := filepath.Join(p, file.Name())
-			switch ext := path.Ext(file.Name()); ext {
-			case ".repo":
-				name := strings.TrimSuffix(file.Name(), ext)
-				if len(name) == 0 {
-					continue
-				}
-				rpmUpstreams, err := LoadRPMRepoUpstreams(filePath)
-				if err != nil {
-					return fmt.Errorf("%s: %v", filePath, err)
-				}
-				upstreams = append(upstreams, rpmUpstreams...)
+			loaded, err := loadFile(filePath, file.Name(), opts)
+			if err != nil {
+				reject(filePath, err)
+				continue
+			}
+			for i := range loaded {
+				loaded[i].Source = filePath
 			}
+			upstreams = append(upstreams, loaded...)
 		}
 	}
+	upstreams, renamed, conflicts := checkNames(upstreams)
+	for _, r := range renamed {
+		log.Printf("warn: upstream %s in %s was renamed to %s, names may only contain letters, digits, '.', '_' and '-'", r.Name, r.Path, r.To)
+	}
+	for _, conflict := range conflicts {
+		log.Printf("error: upstream %s in %s will be ignored: %v", conflict.Section, conflict.Path, conflict.Err)
+	}
+	rejected = append(rejected, conflicts...)
+	m.lock.Lock()
+	m.rejected = rejected
+	m.renamed = renamed
+	m.lock.Unlock()
 
 	config := *m.config
-	config.Upstreams = upstreams
+	config.Upstreams = applyNginxFeatures(applyCacheRules(upstreams, opts.CacheRules), config.Nginx)
+	return config, nil
+}
+
+// Render returns the nginx configuration for config.
+func (m *Generator) Render(config CacheConfig) ([]byte, error) {
 	buf := &bytes.Buffer{}
 	if err := m.template.Execute(buf, config); err != nil {
-		return err
+		return nil, err
 	}
-	if len(m.configPath) == 0 {
-		log.Printf("template:\n%s", buf.String())
-	} else {
-		if err := ioutil.WriteFile(m.configPath, buf.Bytes(), 0640); err != nil {
-			return err
+	return buf.Bytes(), nil
+}
+
+// loadFile returns the upstreams in the file at filePath, or nothing if it is
+// not a recognized kind of file.
+func loadFile(filePath, name string, opts LoadOptions) ([]Upstream, error) {
+	ext := path.Ext(name)
+	// Alpine repository files are conventionally named repositories
+	if name == "repositories" {
+		ext = ".repositories"
+	}
+	switch ext {
+	case ".repo":
+		if len(strings.TrimSuffix(name, ext)) == 0 {
+			return nil, nil
 		}
+		return LoadRPMRepoUpstreams(filePath, opts)
+	case ".list":
+		return LoadAPTListUpstreams(filePath, opts)
+	case ".sources":
+		return LoadAPTSourcesUpstreams(filePath, opts)
+	case ".repositories":
+		return LoadAPKRepositoriesUpstreams(filePath, opts)
+	case ".yaml", ".yml", ".json":
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		return LoadUpstreamDefinitions(filePath, data, opts)
+	case ".upstream":
+		return LoadUpstreams(filePath, opts)
 	}
-	m.setLastConfig(&config)
+	return nil, nil
+}
 
-	return nil
+// writeConfig validates data in a temporary file next to the configuration
+// file and then replaces the configuration file with it.
+func (m *Generator) writeConfig(data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(m.configPath), "."+filepath.Base(m.configPath)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0640); err != nil {
+		return err
+	}
+	if m.validate != nil {
+		if err := m.validate(f.Name()); err != nil {
+			return &ValidationError{Time: time.Now(), Err: err}
+		}
+	}
+	return os.Rename(f.Name(), m.configPath)
 }
 
+// LastConfig returns the configuration that is live.
 func (m *Generator) LastConfig() *CacheConfig {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	return m.lastConfig
 }
 
-func (m *Generator) setLastConfig(config *CacheConfig) {
+// LoadedConfig returns the configuration that was last written, which may not
+// be live yet.
+func (m *Generator) LoadedConfig() *CacheConfig {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.loadedConfig
+}
+
+// LastError returns the reason the most recently generated configuration was
+// rejected, or nil if it was accepted.
+func (m *Generator) LastError() *ValidationError {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.lastError
+}
+
+// Rejected returns the inputs that were ignored the last time configuration
+// was loaded.
+func (m *Generator) Rejected() []RejectedInput {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.rejected
+}
+
+// Renamed returns the upstreams that were renamed the last time configuration
+// was loaded.
+func (m *Generator) Renamed() []RenamedUpstream {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.renamed
+}
+
+// Activate is invoked once the loaded configuration is live.
+func (m *Generator) Activate() {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	m.lastConfig = config
+	m.lastConfig = m.loadedConfig
 }
 
 // makePathRelativeToFile makes a path reference out of a given file relative to the current working dir.
@@ -0,0 +1,212 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MirrorResolver retrieves the mirrors listed by yum mirrorlist and metalink
+// URLs and remembers them so that they can be refreshed periodically.
+type MirrorResolver struct {
+	client *http.Client
+
+	lock  sync.Mutex
+	lists map[string]*mirrorList
+	used  map[string]struct{}
+}
+
+type mirrorList struct {
+	metalink bool
+	mirrors  []string
+}
+
+// NewMirrorResolver creates a resolver that uses client to retrieve lists.
+func NewMirrorResolver(client *http.Client) *MirrorResolver {
+	return &MirrorResolver{
+		client: client,
+		lists:  make(map[string]*mirrorList),
+	}
+}
+
+// Mirrors returns the base URLs of the mirrors listed at listURL, retrieving
+// the list if it has not been seen before. If metalink is true the list is
+// parsed as a metalink document, otherwise the format is detected from the
+// content.
+func (r *MirrorResolver) Mirrors(listURL string, metalink bool) ([]string, error) {
+	r.lock.Lock()
+	if r.used != nil {
+		r.used[listURL] = struct{}{}
+	}
+	list, ok := r.lists[listURL]
+	r.lock.Unlock()
+	if ok {
+		return list.mirrors, nil
+	}
+
+	mirrors, err := r.fetch(listURL, metalink)
+	if err != nil {
+		return nil, err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lists[listURL] = &mirrorList{metalink: metalink, mirrors: mirrors}
+	return mirrors, nil
+}
+
+// BeginLoad starts tracking which lists are used by a configuration load.
+func (r *MirrorResolver) BeginLoad() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.used = make(map[string]struct{})
+}
+
+// EndLoad forgets any list that was not used since BeginLoad so that it is
+// no longer refreshed.
+func (r *MirrorResolver) EndLoad() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for listURL := range r.lists {
+		if _, ok := r.used[listURL]; !ok {
+			delete(r.lists, listURL)
+		}
+	}
+	r.used = nil
+}
+
+// Run refreshes every known list at the provided interval and invokes
+// onChange when the mirrors of any list have changed. It never returns.
+func (r *MirrorResolver) Run(interval time.Duration, onChange func()) {
+	for {
+		time.Sleep(interval)
+		if r.refresh() {
+			log.Printf("Mirror lists changed")
+			onChange()
+		}
+	}
+}
+
+func (r *MirrorResolver) refresh() bool {
+	r.lock.Lock()
+	lists := make(map[string]mirrorList, len(r.lists))
+	for listURL, list := range r.lists {
+		lists[listURL] = *list
+	}
+	r.lock.Unlock()
+
+	changed := false
+	for listURL, list := range lists {
+		mirrors, err := r.fetch(listURL, list.metalink)
+		if err != nil {
+			// keep the last known mirrors until the list can be retrieved
+			log.Printf("warn: unable to refresh mirror list %s: %v", listURL, err)
+			continue
+		}
+		if reflect.DeepEqual(mirrors, list.mirrors) {
+			continue
+		}
+		r.lock.Lock()
+		if existing, ok := r.lists[listURL]; ok {
+			existing.mirrors = mirrors
+			changed = true
+		}
+		r.lock.Unlock()
+	}
+	return changed
+}
+
+func (r *MirrorResolver) fetch(listURL string, metalink bool) ([]string, error) {
+	resp, err := r.client.Get(listURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to retrieve %s: %s", listURL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var mirrors []string
+	if metalink || bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		mirrors, err = parseMetalink(data)
+	} else {
+		mirrors, err = parseMirrorList(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", listURL, err)
+	}
+	if len(mirrors) == 0 {
+		return nil, fmt.Errorf("%s did not list any http or https mirrors", listURL)
+	}
+	return mirrors, nil
+}
+
+// parseMirrorList returns the http and https URLs in a yum mirrorlist, which
+// contains one URL per line.
+func parseMirrorList(data []byte) ([]string, error) {
+	var mirrors []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "http://") && !strings.HasPrefix(line, "https://") {
+			continue
+		}
+		mirrors = append(mirrors, line)
+	}
+	return mirrors, scanner.Err()
+}
+
+type metalinkDocument struct {
+	Files []metalinkFile `xml:"files>file"`
+}
+
+type metalinkFile struct {
+	Name string        `xml:"name,attr"`
+	URLs []metalinkURL `xml:"resources>url"`
+}
+
+type metalinkURL struct {
+	Protocol   string `xml:"protocol,attr"`
+	Preference int    `xml:"preference,attr"`
+	URL        string `xml:",chardata"`
+}
+
+// parseMetalink returns the base URLs of the http and https mirrors that
+// serve repomd.xml, most preferred first.
+func parseMetalink(data []byte) ([]string, error) {
+	var doc metalinkDocument
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var mirrors []string
+	for _, file := range doc.Files {
+		if file.Name != "repomd.xml" {
+			continue
+		}
+		urls := file.URLs
+		sort.SliceStable(urls, func(i, j int) bool { return urls[i].Preference > urls[j].Preference })
+		for _, u := range urls {
+			switch u.Protocol {
+			case "http", "https":
+			default:
+				continue
+			}
+			mirrors = append(mirrors, strings.TrimSuffix(strings.TrimSpace(u.URL), "repodata/repomd.xml"))
+		}
+	}
+	return mirrors, nil
+}
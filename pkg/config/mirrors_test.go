@@ -0,0 +1,102 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMirrorList(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{name: "empty", data: "", want: nil},
+		{
+			name: "one URL per line",
+			data: "http://a.example.com/7/os/x86_64/\nhttps://b.example.com/7/os/x86_64/\n",
+			want: []string{"http://a.example.com/7/os/x86_64/", "https://b.example.com/7/os/x86_64/"},
+		},
+		{
+			name: "comments, blank lines and whitespace",
+			data: "# mirrors for 7\n\n  http://a.example.com/repo/  \r\n#http://commented.example.com/\n",
+			want: []string{"http://a.example.com/repo/"},
+		},
+		{
+			name: "other protocols are skipped",
+			data: "ftp://a.example.com/repo/\nrsync://b.example.com/repo/\nfile:///srv/repo/\nhttps://c.example.com/repo/\n",
+			want: []string{"https://c.example.com/repo/"},
+		},
+		{name: "no final newline", data: "http://a.example.com/repo/", want: []string{"http://a.example.com/repo/"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMirrorList([]byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMetalink(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "most preferred first",
+			data: `<?xml version="1.0" encoding="utf-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/">
+ <files>
+  <file name="repomd.xml">
+   <resources maxconnections="1">
+    <url protocol="http" type="http" location="US" preference="90">http://b.example.com/7/x86_64/repodata/repomd.xml</url>
+    <url protocol="https" type="https" location="US" preference="100">https://a.example.com/7/x86_64/repodata/repomd.xml</url>
+    <url protocol="rsync" type="rsync" location="US" preference="100">rsync://c.example.com/7/x86_64/repodata/repomd.xml</url>
+    <url protocol="ftp" type="ftp" location="US" preference="95">ftp://d.example.com/7/x86_64/repodata/repomd.xml</url>
+   </resources>
+  </file>
+ </files>
+</metalink>`,
+			want: []string{"https://a.example.com/7/x86_64/", "http://b.example.com/7/x86_64/"},
+		},
+		{
+			name: "equal preferences keep their order",
+			data: `<metalink><files><file name="repomd.xml"><resources>
+<url protocol="http" preference="50">http://a.example.com/repodata/repomd.xml</url>
+<url protocol="http" preference="50">http://b.example.com/repodata/repomd.xml</url>
+</resources></file></files></metalink>`,
+			want: []string{"http://a.example.com/", "http://b.example.com/"},
+		},
+		{
+			name: "only repomd.xml is used",
+			data: `<metalink><files>
+<file name="other.xml"><resources><url protocol="http" preference="100">http://other.example.com/other.xml</url></resources></file>
+<file name="repomd.xml"><resources><url protocol="http" preference="10">
+  http://a.example.com/repodata/repomd.xml
+</url></resources></file>
+</files></metalink>`,
+			want: []string{"http://a.example.com/"},
+		},
+		{name: "no files", data: `<metalink></metalink>`, want: nil},
+		{name: "not XML", data: `http://a.example.com/`, wantErr: true},
+		{name: "malformed", data: `<metalink><files>`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMetalink([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// RenamedUpstream is an upstream whose name was not safe to use in URLs or
+// the nginx configuration.
+type RenamedUpstream struct {
+	Path string
+	Name string
+	To   string
+}
+
+var (
+	// namePattern matches names that are safe in URLs, nginx locations and
+	// nginx upstream blocks.
+	namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	// unsafeNameCharacters are replaced when a name is sanitized.
+	unsafeNameCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+	// reservedNames are paths served by the mirror itself, or names used in
+	// the nginx configuration.
+	reservedNames = map[string]struct{}{
+		"healthz":      {},
+		"status":       {},
+		"repositories": {},
+		"v2":           {},
+		"localhost":    {},
+	}
+	// clientConfigSuffixes are appended to the name of an upstream to
+	// retrieve a client configuration for it from the local server. A name
+	// with one of these suffixes would shadow the configuration of another
+	// upstream.
+	clientConfigSuffixes = []string{
+		".repo", ".list", ".sources", ".pip.conf", ".npmrc", ".goenv", ".settings.xml", ".repositories",
+	}
+)
+
+// checkNames ensures that every upstream and mirror has a name that is safe
+// and unique. Unsafe characters in names are replaced with "-". When names
+// collide, the upstream loaded first is kept and later upstreams are rejected.
+// Names are compared without regard to case, as nginx does for upstream
+// blocks.
+func checkNames(upstreams []Upstream) ([]Upstream, []RenamedUpstream, []RejectedInput) {
+	var renamed []RenamedUpstream
+	var rejected []RejectedInput
+
+	// sanitize first, so that references between upstreams can be updated
+	names := make(map[string]string)
+	for i := range upstreams {
+		upstream := &upstreams[i]
+		name := sanitizeName(upstream.Name)
+		if name == upstream.Name || len(name) == 0 {
+			continue
+		}
+		renamed = append(renamed, RenamedUpstream{Path: upstream.Source, Name: upstream.Name, To: name})
+		names[upstream.Name] = name
+		upstream.rename(name)
+	}
+	for i := range upstreams {
+		for j := range upstreams[i].Routes {
+			if to, ok := names[upstreams[i].Routes[j].To]; ok {
+				upstreams[i].Routes[j].To = to
+			}
+		}
+		for j := range upstreams[i].Rewrites {
+			if to, ok := names[upstreams[i].Rewrites[j].To]; ok {
+				upstreams[i].Rewrites[j].To = to
+			}
+		}
+	}
+
+	claimed := make(map[string]Upstream)
+	var accepted []Upstream
+	for _, upstream := range upstreams {
+		if err := checkName(upstream.Name, claimed); err != nil {
+			rejected = append(rejected, RejectedInput{Path: upstream.Source, Section: upstream.Name, Err: err})
+			continue
+		}
+		var err error
+		for _, mirror := range upstream.Mirrors {
+			if err = checkName(mirror.Name, claimed); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			rejected = append(rejected, RejectedInput{Path: upstream.Source, Section: upstream.Name, Err: err})
+			continue
+		}
+		for _, origin := range upstream.Origins() {
+			claimed[strings.ToLower(origin.Name)] = upstream
+		}
+		accepted = append(accepted, upstream)
+	}
+	return accepted, renamed, rejected
+}
+
+// checkName returns an error if name is not valid, reserved or already
+// claimed by an upstream.
+func checkName(name string, claimed map[string]Upstream) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("the name %q must contain a letter or digit", name)
+	}
+	if _, ok := reservedNames[strings.ToLower(name)]; ok {
+		return fmt.Errorf("the name %s is reserved", name)
+	}
+	for _, suffix := range clientConfigSuffixes {
+		if strings.HasSuffix(strings.ToLower(name), suffix) {
+			return fmt.Errorf("the name %s may not end in %s, which serves the client configuration of an upstream", name, suffix)
+		}
+	}
+	if existing, ok := claimed[strings.ToLower(name)]; ok {
+		if len(existing.Source) > 0 {
+			return fmt.Errorf("the name %s is already used by %s in %s", name, existing.Name, existing.Source)
+		}
+		return fmt.Errorf("the name %s is already used by %s", name, existing.Name)
+	}
+	return nil
+}
+
+// sanitizeName replaces characters that are not safe in a name with "-".
+func sanitizeName(name string) string {
+	name = unsafeNameCharacters.ReplaceAllString(name, "-")
+	return strings.TrimLeft(name, ".-_")
+}
+
+// rename gives the upstream and its mirrors names derived from name.
+func (u *Upstream) rename(name string) {
+	u.setName(name)
+	for i := range u.Mirrors {
+		u.Mirrors[i].setName(mirrorName(name, i+1))
+	}
+	u.Fallback = ""
+	if len(u.Mirrors) > 0 {
+		u.Fallback = u.Mirrors[0].Name
+	}
+	for i := 0; i+1 < len(u.Mirrors); i++ {
+		u.Mirrors[i].Fallback = u.Mirrors[i+1].Name
+	}
+}
+
+// setName renames a single origin, which is also the host it is proxied to.
+func (u *Upstream) setName(name string) {
+	u.Name = name
+	// the host of the current URL may not parse if the name was not safe
+	if proxyPassURL, err := url.Parse(u.Origin); err == nil {
+		proxyPassURL.Host = name
+		u.URL = proxyPassURL.String()
+	}
+	if len(u.Tunnel) > 0 {
+		u.Tunnel = filepath.Join(filepath.Dir(u.Tunnel), name+".sock")
+	}
+}
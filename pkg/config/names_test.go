@@ -0,0 +1,171 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// namedUpstream returns an upstream loaded from source with the given number
+// of mirrors, named as the loaders name them.
+func namedUpstream(name, source string, mirrors int) Upstream {
+	var origins []Upstream
+	for i := 0; i <= mirrors; i++ {
+		u := &url.URL{Scheme: "http", Host: fmt.Sprintf("%d.example.com", i), Path: "/repo/"}
+		origin := newOrigin(mirrorName(name, i), u, LoadOptions{})
+		origin.Source = source
+		origins = append(origins, origin)
+	}
+	return chainOrigins(UpstreamTypeRPM, origins)
+}
+
+func TestCheckNames(t *testing.T) {
+	tests := []struct {
+		name      string
+		upstreams []Upstream
+		// accepted lists the names of the accepted upstreams followed by
+		// those of their mirrors
+		accepted [][]string
+		renamed  []RenamedUpstream
+		// rejected maps the rejected sections to part of the error
+		rejected map[string]string
+	}{
+		{
+			name:      "valid names are unchanged",
+			upstreams: []Upstream{namedUpstream("base", "a.repo", 2), namedUpstream("Updates_7.9", "a.repo", 0)},
+			accepted:  [][]string{{"base", "base-mirror-1", "base-mirror-2"}, {"Updates_7.9"}},
+		},
+		{
+			name:      "unsafe characters are replaced",
+			upstreams: []Upstream{namedUpstream("my repo/x86_64", "a.repo", 1), namedUpstream("..hidden", "b.repo", 0)},
+			accepted:  [][]string{{"my-repo-x86_64", "my-repo-x86_64-mirror-1"}, {"hidden"}},
+			renamed: []RenamedUpstream{
+				{Path: "a.repo", Name: "my repo/x86_64", To: "my-repo-x86_64"},
+				{Path: "b.repo", Name: "..hidden", To: "hidden"},
+			},
+		},
+		{
+			name:      "names without a letter or digit are rejected",
+			upstreams: []Upstream{namedUpstream("...", "a.repo", 0), namedUpstream("base", "a.repo", 0)},
+			accepted:  [][]string{{"base"}},
+			rejected:  map[string]string{"...": "must contain a letter or digit"},
+		},
+		{
+			name: "reserved names are rejected regardless of case",
+			upstreams: []Upstream{
+				namedUpstream("healthz", "a.repo", 0),
+				namedUpstream("Status", "a.repo", 0),
+				namedUpstream("v2", "a.repo", 0),
+				namedUpstream("localhost", "a.repo", 0),
+				namedUpstream("repositories", "a.repo", 0),
+			},
+			rejected: map[string]string{
+				"healthz":      "is reserved",
+				"Status":       "is reserved",
+				"v2":           "is reserved",
+				"localhost":    "is reserved",
+				"repositories": "is reserved",
+			},
+		},
+		{
+			name: "names ending in a client configuration suffix are rejected",
+			upstreams: []Upstream{
+				namedUpstream("base.repo", "a.repo", 0),
+				namedUpstream("debian.LIST", "a.repo", 0),
+				namedUpstream("pypi.pip.conf", "a.repo", 0),
+				namedUpstream("central.settings.xml", "a.repo", 0),
+				namedUpstream("alpine.repositories", "a.repo", 0),
+				namedUpstream("repo.d", "a.repo", 0),
+			},
+			accepted: [][]string{{"repo.d"}},
+			rejected: map[string]string{
+				"base.repo":            "may not end in .repo",
+				"debian.LIST":          "may not end in .list",
+				"pypi.pip.conf":        "may not end in .pip.conf",
+				"central.settings.xml": "may not end in .settings.xml",
+				"alpine.repositories":  "may not end in .repositories",
+			},
+		},
+		{
+			name:      "the first upstream with a name is kept",
+			upstreams: []Upstream{namedUpstream("base", "a.repo", 0), namedUpstream("BASE", "b.repo", 0)},
+			accepted:  [][]string{{"base"}},
+			rejected:  map[string]string{"BASE": "already used by base in a.repo"},
+		},
+		{
+			name:      "upstreams whose mirrors collide are rejected",
+			upstreams: []Upstream{namedUpstream("base-mirror-1", "a.repo", 0), namedUpstream("base", "b.repo", 1)},
+			accepted:  [][]string{{"base-mirror-1"}},
+			rejected:  map[string]string{"base": "already used by base-mirror-1 in a.repo"},
+		},
+		{
+			name:      "names that collide after they are sanitized",
+			upstreams: []Upstream{namedUpstream("my-repo", "a.repo", 0), namedUpstream("my repo", "b.repo", 0)},
+			accepted:  [][]string{{"my-repo"}},
+			renamed:   []RenamedUpstream{{Path: "b.repo", Name: "my repo", To: "my-repo"}},
+			rejected:  map[string]string{"my-repo": "already used by my-repo in a.repo"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accepted, renamed, rejected := checkNames(tt.upstreams)
+
+			var names [][]string
+			for _, upstream := range accepted {
+				var origins []string
+				for _, origin := range upstream.Origins() {
+					origins = append(origins, origin.Name)
+				}
+				names = append(names, origins)
+			}
+			if !reflect.DeepEqual(names, tt.accepted) {
+				t.Errorf("accepted %q, want %q", names, tt.accepted)
+			}
+			if !reflect.DeepEqual(renamed, tt.renamed) {
+				t.Errorf("renamed %#v, want %#v", renamed, tt.renamed)
+			}
+			if len(rejected) != len(tt.rejected) {
+				t.Errorf("rejected %d upstreams, want %d: %v", len(rejected), len(tt.rejected), rejected)
+			}
+			for _, r := range rejected {
+				want, ok := tt.rejected[r.Section]
+				if !ok {
+					t.Errorf("unexpected rejection of %s: %v", r.Section, r.Err)
+					continue
+				}
+				if !strings.Contains(r.Err.Error(), want) {
+					t.Errorf("rejection of %s: %v does not contain %q", r.Section, r.Err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckNamesUpdatesReferences(t *testing.T) {
+	upstreams := []Upstream{
+		namedUpstream("my files", "a.def", 1),
+		namedUpstream("index", "a.def", 0),
+	}
+	upstreams[1].Routes = []Route{{Path: "files/", To: "my files"}}
+	upstreams[1].Rewrites = []Rewrite{{From: "https://files.example.com/", To: "my files"}}
+
+	accepted, _, rejected := checkNames(upstreams)
+	if len(rejected) > 0 {
+		t.Fatalf("unexpected rejections: %v", rejected)
+	}
+	renamed := accepted[0]
+	if renamed.URL != "http://my-files/repo/" || renamed.Fallback != "my-files-mirror-1" {
+		t.Errorf("the renamed upstream proxies to %s and falls back to %s", renamed.URL, renamed.Fallback)
+	}
+	if mirror := renamed.Mirrors[0]; mirror.Name != "my-files-mirror-1" || mirror.URL != "http://my-files-mirror-1/repo/" {
+		t.Errorf("the mirror of the renamed upstream is %s and proxies to %s", mirror.Name, mirror.URL)
+	}
+	if to := accepted[1].Routes[0].To; to != "my-files" {
+		t.Errorf("the route refers to %s", to)
+	}
+	if to := accepted[1].Rewrites[0].To; to != "my-files" {
+		t.Errorf("the rewrite refers to %s", to)
+	}
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// NginxFeatures describes the nginx binary the configuration is generated
+// for. The zero value describes an unknown nginx, which is assumed to support
+// every directive the configuration uses.
+type NginxFeatures struct {
+	// Version is the version of nginx, such as 1.20.1.
+	Version string
+	// Modules records the modules nginx was configured with or without,
+	// such as http_ssl_module.
+	Modules map[string]bool
+}
+
+// optionalNginxModules are the modules the configuration uses that are only
+// built when nginx is configured --with them. Every other module is built
+// unless nginx is configured --without it.
+var optionalNginxModules = map[string]struct{}{
+	"http_ssl_module":          {},
+	"http_sub_module":          {},
+	"http_auth_request_module": {},
+	"http_v2_module":           {},
+}
+
+// ParseNginxFeatures reads the version and modules from the output of
+// nginx -V.
+func ParseNginxFeatures(output string) (NginxFeatures, error) {
+	features := NginxFeatures{Modules: make(map[string]bool)}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "nginx version:"):
+			version := strings.TrimSpace(strings.TrimPrefix(line, "nginx version:"))
+			if i := strings.Index(version, "/"); i != -1 {
+				version = version[i+1:]
+			}
+			if i := strings.IndexAny(version, " ("); i != -1 {
+				version = version[:i]
+			}
+			if _, ok := parseNginxVersion(version); !ok {
+				return NginxFeatures{}, fmt.Errorf("unrecognized nginx version %q", version)
+			}
+			features.Version = version
+		case strings.HasPrefix(line, "configure arguments:"):
+			for _, arg := range strings.Fields(strings.TrimPrefix(line, "configure arguments:")) {
+				switch {
+				case strings.HasPrefix(arg, "--with-") && strings.HasSuffix(arg, "_module"):
+					features.Modules[strings.TrimPrefix(arg, "--with-")] = true
+				case strings.HasPrefix(arg, "--with-") && strings.HasSuffix(arg, "_module=dynamic"):
+					// dynamic modules are not loaded by the configuration
+					features.Modules[strings.TrimSuffix(strings.TrimPrefix(arg, "--with-"), "=dynamic")] = false
+				case strings.HasPrefix(arg, "--without-") && strings.HasSuffix(arg, "_module"):
+					features.Modules[strings.TrimPrefix(arg, "--without-")] = false
+				}
+			}
+		}
+	}
+	if len(features.Version) == 0 {
+		return NginxFeatures{}, fmt.Errorf("nginx did not report its version")
+	}
+	return features, nil
+}
+
+// AtLeast returns true if nginx is the given version or newer.
+func (f NginxFeatures) AtLeast(version string) bool {
+	if len(f.Version) == 0 {
+		return true
+	}
+	have, _ := parseNginxVersion(f.Version)
+	want, ok := parseNginxVersion(version)
+	if !ok {
+		return false
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			return have[i] > want[i]
+		}
+	}
+	return true
+}
+
+// HasModule returns true if nginx includes the named module, such as
+// http_sub_module. Modules built as dynamic modules are not loaded by the
+// configuration and are not included.
+func (f NginxFeatures) HasModule(name string) bool {
+	if len(f.Version) == 0 {
+		return true
+	}
+	if built, ok := f.Modules[name]; ok {
+		return built
+	}
+	_, optional := optionalNginxModules[name]
+	return !optional
+}
+
+// parseNginxVersion splits a version such as 1.20.1 into its numbers.
+func parseNginxVersion(version string) ([3]int, bool) {
+	var numbers [3]int
+	parts := strings.Split(version, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return numbers, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return numbers, false
+		}
+		numbers[i] = n
+	}
+	return numbers, true
+}
+
+// applyNginxFeatures removes settings from upstreams that nginx cannot apply.
+// Links in responses can only be rewritten by the sub module.
+func applyNginxFeatures(upstreams []Upstream, nginx NginxFeatures) []Upstream {
+	if nginx.HasModule("http_sub_module") {
+		return upstreams
+	}
+	for i := range upstreams {
+		if len(upstreams[i].Rewrites) == 0 {
+			continue
+		}
+		log.Printf("warn: nginx does not include http_sub_module, links in responses from %s will not be rewritten to the mirror", upstreams[i].Name)
+		upstreams[i].Rewrites = nil
+		for j := range upstreams[i].Mirrors {
+			upstreams[i].Mirrors[j].Rewrites = nil
+		}
+	}
+	return upstreams
+}
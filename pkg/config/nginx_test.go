@@ -0,0 +1,115 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNginxFeatures(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    NginxFeatures
+		wantErr bool
+	}{
+		{
+			name: "packaged nginx",
+			output: `nginx version: nginx/1.20.1
+built by gcc 11.3.1 20220421 (Red Hat 11.3.1-2) (GCC)
+built with OpenSSL 3.0.1 14 Dec 2021
+TLS SNI support enabled
+configure arguments: --prefix=/usr/share/nginx --with-http_ssl_module --with-http_v2_module --with-http_sub_module --with-http_xslt_module=dynamic --without-http_gzip_module --with-pcre --with-stream=dynamic
+`,
+			want: NginxFeatures{
+				Version: "1.20.1",
+				Modules: map[string]bool{
+					"http_ssl_module":  true,
+					"http_v2_module":   true,
+					"http_sub_module":  true,
+					"http_xslt_module": false,
+					"http_gzip_module": false,
+				},
+			},
+		},
+		{
+			name:   "distribution suffix",
+			output: "nginx version: nginx/1.18.0 (Ubuntu)\r\nconfigure arguments:\r\n",
+			want:   NginxFeatures{Version: "1.18.0", Modules: map[string]bool{}},
+		},
+		{
+			name:   "no configure arguments",
+			output: "nginx version: nginx/1.25\n",
+			want:   NginxFeatures{Version: "1.25", Modules: map[string]bool{}},
+		},
+		{name: "empty", output: "", wantErr: true},
+		{name: "no version", output: "configure arguments: --with-http_ssl_module\n", wantErr: true},
+		{name: "not a version", output: "nginx version: nginx/latest\n", wantErr: true},
+		{name: "too many numbers", output: "nginx version: nginx/1.2.3.4\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseNginxFeatures(tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNginxFeaturesAtLeast(t *testing.T) {
+	tests := []struct {
+		have    string
+		version string
+		want    bool
+	}{
+		{have: "1.20.1", version: "1.20.1", want: true},
+		{have: "1.20.1", version: "1.19.4", want: true},
+		{have: "1.20.1", version: "1.20", want: true},
+		{have: "1.20.1", version: "1.20.2", want: false},
+		{have: "1.9.15", version: "1.13.0", want: false},
+		{have: "2.0", version: "1.25.3", want: true},
+		{have: "1.20.1", version: "latest", want: false},
+		// an unknown nginx is assumed to be recent
+		{have: "", version: "1.25.0", want: true},
+	}
+	for _, tt := range tests {
+		if got := (NginxFeatures{Version: tt.have}).AtLeast(tt.version); got != tt.want {
+			t.Errorf("%q.AtLeast(%q) = %t, want %t", tt.have, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestNginxFeaturesHasModule(t *testing.T) {
+	features, err := ParseNginxFeatures("nginx version: nginx/1.20.1\nconfigure arguments: --with-http_ssl_module --with-http_xslt_module=dynamic --without-http_gzip_module\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		module string
+		want   bool
+	}{
+		{module: "http_ssl_module", want: true},
+		{module: "http_gzip_module", want: false},
+		// built unless configured without
+		{module: "http_proxy_module", want: true},
+		// only built when configured with
+		{module: "http_sub_module", want: false},
+		{module: "http_v2_module", want: false},
+		// dynamic modules are not loaded
+		{module: "http_xslt_module", want: false},
+	}
+	for _, tt := range tests {
+		if got := features.HasModule(tt.module); got != tt.want {
+			t.Errorf("HasModule(%q) = %t, want %t", tt.module, got, tt.want)
+		}
+	}
+	if !(NginxFeatures{}).HasModule("http_sub_module") {
+		t.Errorf("an unknown nginx should be assumed to have every module")
+	}
+}
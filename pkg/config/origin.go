@@ -0,0 +1,139 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// newOrigin returns an upstream named name that retrieves content from u. If
+// u is an https URL the upstream is verified with the configured CA bundle
+// when verification is enabled.
+func newOrigin(name string, u *url.URL, opts LoadOptions) Upstream {
+	origin := Upstream{
+		Name:   name,
+		Origin: u.String(),
+		Path:   u.Path,
+		Hosts:  []string{hostPort(u)},
+	}
+	if u.Scheme == "https" {
+		origin.TLS = true
+		origin.ServerName = u.Hostname()
+		if opts.VerifyTLS {
+			origin.CACertificatePath = opts.CABundlePath
+		}
+	}
+	proxyPassURL := *u
+	proxyPassURL.Host = name
+	origin.URL = proxyPassURL.String()
+	return origin
+}
+
+// originSettings are the TLS, authentication and proxy settings shared by
+// every origin of a repository. Paths must already be resolved.
+type originSettings struct {
+	SSLVerify            bool
+	CACertificatePath    string
+	ClientCertificate    string
+	ClientCertificateKey string
+
+	Username string
+	Password string
+
+	Proxy         string
+	ProxyUsername string
+	ProxyPassword string
+}
+
+// configureOrigin applies settings to origin.
+func configureOrigin(origin *Upstream, settings originSettings, opts LoadOptions) error {
+	if origin.TLS {
+		origin.CertificatePath = settings.ClientCertificate
+		origin.KeyPath = settings.ClientCertificateKey
+		origin.CACertificatePath = ""
+		if settings.SSLVerify && (opts.VerifyTLS || len(origin.CertificatePath) > 0) {
+			switch {
+			case len(settings.CACertificatePath) > 0:
+				origin.CACertificatePath = settings.CACertificatePath
+			case len(opts.CABundlePath) > 0:
+				origin.CACertificatePath = opts.CABundlePath
+			default:
+				log.Printf("warn: upstream %s requests TLS verification but no CA bundle is configured, the upstream will not be verified", origin.Name)
+			}
+		}
+	}
+	if len(settings.Username) > 0 {
+		origin.Authorization = basicAuthorization(settings.Username, settings.Password)
+	}
+	if proxy := strings.TrimSpace(settings.Proxy); len(proxy) > 0 && proxy != "_none_" {
+		if err := setOriginProxy(origin, proxy, settings.ProxyUsername, settings.ProxyPassword, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mirrorName returns the name of the origin at index i of the named upstream.
+func mirrorName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s-mirror-%d", name, i)
+}
+
+// chainOrigins returns the first origin with the remaining origins as its
+// mirrors, each falling back to the next. All origins are given type t.
+func chainOrigins(t UpstreamType, origins []Upstream) Upstream {
+	for i := range origins {
+		origins[i].Type = t
+		if i > 0 {
+			origins[i-1].Fallback = origins[i].Name
+		}
+	}
+	upstream := origins[0]
+	upstream.Mirrors = origins[1:]
+	return upstream
+}
+
+// setOriginProxy configures origin to be reached through the HTTP proxy at
+// proxy. Credentials in the proxy URL take precedence over username and
+// password.
+func setOriginProxy(origin *Upstream, proxy, username, password string, opts LoadOptions) error {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || (proxyURL.Scheme != "http" && proxyURL.Scheme != "https") || len(proxyURL.Host) == 0 {
+		return fmt.Errorf("the proxy is not a valid http or https URL")
+	}
+	if proxyURL.User != nil {
+		username = proxyURL.User.Username()
+		password, _ = proxyURL.User.Password()
+		proxyURL.User = nil
+	}
+	origin.Proxy = proxyURL.String()
+	if len(username) > 0 {
+		origin.ProxyAuthorization = basicAuthorization(username, password)
+	}
+	// the name is only checked later, and must not escape the directory
+	origin.Tunnel = filepath.Join(opts.TunnelDir, sanitizeName(origin.Name)+".sock")
+	return nil
+}
+
+// basicAuthorization returns the value of an Authorization header for HTTP
+// basic authentication.
+func basicAuthorization(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// hostPort returns the host and port of url, using the default port for the
+// scheme if none is set.
+func hostPort(url *url.URL) string {
+	if url.Scheme == "https" {
+		if _, _, err := net.SplitHostPort(url.Host); err != nil {
+			return net.JoinHostPort(url.Host, "443")
+		}
+	}
+	return url.Host
+}
@@ -3,7 +3,6 @@ package config
 import (
 	"fmt"
 	"log"
-	"net"
 	"net/url"
 	"strings"
 
@@ -14,82 +13,165 @@ type RPMRepositorySection struct {
 	ID            string `ini:"id"`
 	Name          string
 	BaseURL       string `ini:"baseurl"`
+	MirrorList    string `ini:"mirrorlist"`
+	Metalink      string `ini:"metalink"`
 	Enabled       int
 	SSLVerify     bool   `ini:"sslverify"`
+	SSLCACert     string `ini:"sslcacert"`
 	SSLClientKey  string `ini:"sslclientkey"`
 	SSLClientCert string `ini:"sslclientcert"`
+	Username      string `ini:"username"`
+	Password      string `ini:"password"`
+	Proxy         string `ini:"proxy"`
+	ProxyUsername string `ini:"proxy_username"`
+	ProxyPassword string `ini:"proxy_password"`
 }
 
-func LoadRPMRepoUpstreams(iniFile string) ([]Upstream, error) {
+func LoadRPMRepoUpstreams(iniFile string, opts LoadOptions) ([]Upstream, error) {
 	var upstreams []Upstream
 	cfg, err := ini.Load(iniFile)
 	if err != nil {
 		return nil, err
 	}
+	// yum applies the proxy settings of the main section to every repository
+	// that does not set its own
+	defaults := &RPMRepositorySection{}
+	if main, err := cfg.GetSection("main"); err == nil {
+		if err := main.MapTo(defaults); err != nil {
+			return nil, &SectionError{Section: main.Name(), Err: err}
+		}
+	}
 	for _, section := range cfg.Sections() {
-		if !section.Haskey("baseurl") {
+		if !section.Haskey("baseurl") && !section.Haskey("mirrorlist") && !section.Haskey("metalink") {
 			continue
 		}
 		repo := &RPMRepositorySection{
-			ID:      section.Name(),
-			Enabled: 1,
+			ID:            section.Name(),
+			Enabled:       1,
+			SSLVerify:     true,
+			Proxy:         defaults.Proxy,
+			ProxyUsername: defaults.ProxyUsername,
+			ProxyPassword: defaults.ProxyPassword,
 		}
 		if err := section.MapTo(repo); err != nil {
-			return nil, fmt.Errorf("%s can't load section %s: %v", iniFile, section.Name(), err)
+			return nil, &SectionError{Section: section.Name(), Err: err}
 		}
 		if repo.Enabled == 0 {
 			continue
 		}
-		var urls []*url.URL
-		for _, u := range strings.Split(repo.BaseURL, " ") {
-			u = strings.TrimSpace(u)
-			if len(u) == 0 {
-				continue
+
+		// a repository that depends on the architecture is mirrored once per
+		// requested architecture
+		names := []string{repo.ID}
+		varsByName := []Variables{opts.Variables}
+		if len(opts.Architectures) > 0 && opts.Variables.References(repo.BaseURL+repo.MirrorList+repo.Metalink, "basearch") {
+			names, varsByName = nil, nil
+			for _, arch := range opts.Architectures {
+				names = append(names, fmt.Sprintf("%s-%s", repo.ID, arch))
+				varsByName = append(varsByName, opts.Variables.With("basearch", arch).With("arch", arch))
 			}
-			url, err := url.Parse(u)
+		}
+
+		for i, name := range names {
+			vars := varsByName[i]
+			baseURLs := strings.Fields(repo.BaseURL)
+			mirrors, err := rpmMirrors(repo, vars, opts)
 			if err != nil {
-				return nil, fmt.Errorf("repo %s has a base URL that is not a valid URL: %v", iniFile, u)
+				return nil, &SectionError{Section: repo.ID, Err: err}
 			}
-			if !strings.HasSuffix(url.Path, "/") {
-				url.Path += "/"
+			baseURLs = append(baseURLs, mirrors...)
+			upstream, err := newRPMUpstream(iniFile, name, repo, baseURLs, vars, opts)
+			if err != nil {
+				return nil, &SectionError{Section: repo.ID, Err: err}
 			}
-			urls = append(urls, url)
+			upstreams = append(upstreams, upstream)
 		}
-		if len(urls) == 0 {
-			return nil, fmt.Errorf("repo %s has no baseurls", iniFile)
-		}
-		var hosts []string
-		proxyPassURL := urls[0]
-		for _, url := range urls {
-			if url.Path == proxyPassURL.Path {
-				if url.Scheme == "https" {
-					if _, _, err := net.SplitHostPort(url.Host); err != nil {
-						hosts = append(hosts, net.JoinHostPort(url.Host, "443"))
-					} else {
-						hosts = append(hosts, url.Host)
-					}
-				} else {
-					hosts = append(hosts, url.Host)
-				}
-			}
+	}
+	return upstreams, nil
+}
+
+// rpmMirrors returns the base URLs listed by the metalink or mirrorlist of
+// the repository, if any.
+func rpmMirrors(repo *RPMRepositorySection, vars Variables, opts LoadOptions) ([]string, error) {
+	listURL, metalink := repo.MirrorList, false
+	if len(repo.Metalink) > 0 {
+		listURL, metalink = repo.Metalink, true
+	}
+	listURL = strings.TrimSpace(listURL)
+	if len(listURL) == 0 {
+		return nil, nil
+	}
+	if opts.Mirrors == nil {
+		if len(repo.BaseURL) > 0 {
+			return nil, nil
 		}
-		if len(hosts) != len(urls) {
-			log.Printf("one or more baseurls were omitted because they don't have a consistent path: %s", proxyPassURL.Path)
+		return nil, fmt.Errorf("mirror lists are not supported")
+	}
+	listURL = vars.Expand(listURL)
+	if strings.Contains(listURL, "$") {
+		return nil, fmt.Errorf("the mirror list URL has an undefined variable: %s", listURL)
+	}
+	mirrors, err := opts.Mirrors.Mirrors(listURL, metalink)
+	if err != nil {
+		if len(repo.BaseURL) > 0 {
+			log.Printf("warn: repo %s will only use its baseurls: %v", repo.ID, err)
+			return nil, nil
 		}
-		proxyPassURL.Host = repo.ID
+		return nil, err
+	}
+	return mirrors, nil
+}
 
-		upstream := Upstream{
-			Repo:  true,
-			Name:  repo.ID,
-			Hosts: hosts,
-			URL:   proxyPassURL.String(),
+// newRPMUpstream creates an upstream named name for the provided repository
+// section and base URLs, expanding any variables in them.
+func newRPMUpstream(iniFile, name string, repo *RPMRepositorySection, baseURLs []string, vars Variables, opts LoadOptions) (Upstream, error) {
+	var urls []*url.URL
+	for _, u := range baseURLs {
+		expanded := vars.Expand(u)
+		if strings.Contains(expanded, "$") {
+			return Upstream{}, fmt.Errorf("the base URL %s has an undefined variable", u)
 		}
-		if len(repo.SSLClientCert) > 0 {
-			upstream.TLS = true
-			upstream.CertificatePath = makePathRelativeToFile(iniFile, repo.SSLClientCert)
-			upstream.KeyPath = makePathRelativeToFile(iniFile, repo.SSLClientKey)
+		url, err := url.Parse(expanded)
+		if err != nil {
+			return Upstream{}, fmt.Errorf("the base URL %s is not a valid URL", u)
 		}
-		upstreams = append(upstreams, upstream)
+		if !strings.HasSuffix(url.Path, "/") {
+			url.Path += "/"
+		}
+		urls = append(urls, url)
 	}
-	return upstreams, nil
+	if len(urls) == 0 {
+		return Upstream{}, fmt.Errorf("there are no baseurls or mirrors")
+	}
+
+	settings := originSettings{
+		SSLVerify:     repo.SSLVerify,
+		Username:      repo.Username,
+		Password:      repo.Password,
+		Proxy:         vars.Expand(repo.Proxy),
+		ProxyUsername: repo.ProxyUsername,
+		ProxyPassword: repo.ProxyPassword,
+	}
+	if len(repo.SSLCACert) > 0 {
+		settings.CACertificatePath = makePathRelativeToFile(iniFile, vars.Expand(repo.SSLCACert))
+	}
+	if len(repo.SSLClientCert) > 0 {
+		settings.ClientCertificate = makePathRelativeToFile(iniFile, vars.Expand(repo.SSLClientCert))
+		settings.ClientCertificateKey = makePathRelativeToFile(iniFile, vars.Expand(repo.SSLClientKey))
+	}
+
+	// each base URL is a distinct origin, tried in order
+	var origins []Upstream
+	for i, url := range urls {
+		origin := newOrigin(mirrorName(name, i), url, opts)
+		if err := configureOrigin(&origin, settings, opts); err != nil {
+			return Upstream{}, err
+		}
+		origins = append(origins, origin)
+	}
+
+	upstream := chainOrigins(UpstreamTypeRPM, origins)
+	upstream.Repo = true
+	upstream.HealthPath = "repodata/repomd.xml"
+	return upstream, nil
 }
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// TransportKey identifies the settings Transport depends on, so that
+// transports can be shared between origins.
+func (u Upstream) TransportKey() string {
+	return strings.Join([]string{u.ServerName, u.CACertificatePath, u.CertificatePath, u.KeyPath, u.Proxy, u.ProxyAuthorization}, "\x00")
+}
+
+// Transport returns a transport with the same TLS and proxy settings nginx
+// uses to contact the origin.
+func (u Upstream) Transport() (*http.Transport, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         u.ServerName,
+		InsecureSkipVerify: len(u.CACertificatePath) == 0,
+	}
+	if len(u.CACertificatePath) > 0 {
+		data, err := ioutil.ReadFile(u.CACertificatePath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates could be read from %s", u.CACertificatePath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(u.CertificatePath) > 0 {
+		cert, err := tls.LoadX509KeyPair(u.CertificatePath, u.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+	if len(u.Proxy) > 0 {
+		proxyURL, err := url.Parse(u.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+		if len(u.ProxyAuthorization) > 0 {
+			transport.ProxyConnectHeader = http.Header{"Proxy-Authorization": []string{u.ProxyAuthorization}}
+		}
+	}
+	return transport, nil
+}
+
+// ProxyTransport returns a transport for hosts other than the origin, which
+// verifies servers with the system roots and uses the proxy of the origin.
+func (u Upstream) ProxyTransport() (*http.Transport, error) {
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if len(u.Proxy) > 0 {
+		proxyURL, err := url.Parse(u.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+		if len(u.ProxyAuthorization) > 0 {
+			transport.ProxyConnectHeader = http.Header{"Proxy-Authorization": []string{u.ProxyAuthorization}}
+		}
+	}
+	return transport, nil
+}
@@ -7,26 +7,195 @@ type CacheConfig struct {
 	InactiveDuration string
 
 	LogLevel string
+	// RuntimeDir holds the pid file, temporary files and logs of nginx. If
+	// empty the paths nginx was built with are used.
+	RuntimeDir string
+	// Nginx describes the nginx the configuration is generated for, which
+	// determines the directives that are used.
+	Nginx NginxFeatures
 
 	Frontends []Frontend
 	Upstreams []Upstream
 }
 
+// Frontend is a server nginx listens on.
 type Frontend struct {
+	// Name identifies the frontend to the local server.
+	Name string
+	// ServerNames, if set, are the host names the frontend serves. Requests
+	// to the same address for other hosts are served by another frontend.
+	ServerNames []string
+	// Upstreams selects the upstreams the frontend serves, by name, by glob
+	// of the name, or by a label of the form key=value whose value may be a
+	// glob. If empty every upstream is served.
+	Upstreams []string
+
 	Listen          string
 	CertificatePath string
 	KeyPath         string
+	// Protocols and Ciphers restrict the TLS versions and ciphers that
+	// are accepted. If empty the nginx defaults apply.
+	Protocols []string
+	Ciphers   string
+	// HTTPSRedirectPort, if set, redirects requests other than health
+	// checks to HTTPS on this port instead of serving content.
+	HTTPSRedirectPort string
 }
 
-type Upstream struct {
+// UpstreamType identifies the kind of content an upstream serves.
+type UpstreamType string
+
+const (
+	UpstreamTypeRPM UpstreamType = "rpm"
+	UpstreamTypeAPT UpstreamType = "apt"
+	// UpstreamTypePyPI is a PEP 503 or PEP 691 simple index, and
+	// UpstreamTypePyPIFiles the package files it links to.
+	UpstreamTypePyPI      UpstreamType = "pypi"
+	UpstreamTypePyPIFiles UpstreamType = "pypi-files"
+	// UpstreamTypeGoProxy is a Go module proxy, and UpstreamTypeGoSumDB the
+	// checksum database it serves under sumdb/.
+	UpstreamTypeGoProxy UpstreamType = "goproxy"
+	UpstreamTypeGoSumDB UpstreamType = "gosumdb"
+	// UpstreamTypeRegistry is an OCI distribution (Docker) registry, served
+	// under /v2/<name>/. The mirror authenticates to the registry on behalf
+	// of clients.
+	UpstreamTypeRegistry UpstreamType = "registry"
+	UpstreamTypeNPM      UpstreamType = "npm"
+	UpstreamTypeMaven    UpstreamType = "maven"
+	// UpstreamTypeHelm is a Helm chart repository, whose index is rewritten
+	// by the local server.
+	UpstreamTypeHelm UpstreamType = "helm"
+	UpstreamTypeAPK  UpstreamType = "apk"
+	// UpstreamTypeGeneric is content with no known structure, cached
+	// according to its cache rules.
+	UpstreamTypeGeneric UpstreamType = "generic"
+)
+
+// Header is sent to an upstream with every request.
+type Header struct {
 	Name  string
-	URL   string
-	Hosts []string
+	Value string
+}
+
+// Route serves requests for Path, relative to the upstream, from the upstream
+// named To.
+type Route struct {
+	Path string
+	To   string
+}
+
+// Rewrite replaces the absolute URL prefix From in responses with the URL of
+// the upstream named To on the mirror.
+type Rewrite struct {
+	From string
+	To   string
+}
+
+type Upstream struct {
+	Name string
+	// Source is the file the upstream was loaded from.
+	Source string
+	Type   UpstreamType
+	URL    string
+	Hosts  []string
+	// HostHeader is sent as the Host header if Hosts are not the host of the
+	// origin.
+	HostHeader string
+
+	// Origin is the URL content is retrieved from and Path is its path,
+	// ending in a slash.
+	Origin string
+	Path   string
+	// HealthPath, if set, is requested relative to each origin to determine
+	// whether it is healthy.
+	HealthPath string
+	// Mirrors are additional origins for the same content that are tried
+	// in order when the upstream fails or does not have the content.
+	Mirrors []Upstream
+	// Fallback is the name of the next mirror to try, if any.
+	Fallback string
+
+	// APT lists the sources of an APT upstream.
+	APT []APTEntry
+	// APKTag is the tag clients refer to an Alpine repository by, if any.
+	APKTag string
+	// Rewrites are applied to the content of responses.
+	Rewrites []Rewrite
+	// Routes are paths below the upstream served by other upstreams.
+	Routes []Route
+	// CacheRules are applied in order, the first rule whose pattern
+	// matches the path wins.
+	CacheRules []CacheRule
+	// Cache applies to paths that match none of the CacheRules.
+	Cache CacheRule
 
 	Repo bool
+	// Labels are used by frontends to select the upstreams they serve.
+	Labels map[string]string
 
-	TLS               bool
+	TLS bool
+	// ServerName is the name sent via SNI and verified against the upstream
+	// certificate.
+	ServerName        string
 	CACertificatePath string
 	CertificatePath   string
 	KeyPath           string
+
+	// Authorization and Headers are sent to the upstream with every request.
+	Authorization string
+	Headers       []Header
+	// Proxy is the URL of an HTTP proxy that the upstream is reached through.
+	// Connections are made through a tunnel listening on the Tunnel unix
+	// socket, which uses ProxyAuthorization to authenticate to the proxy.
+	Proxy              string
+	ProxyAuthorization string
+	Tunnel             string
+}
+
+// HasUpstreamType returns true if any upstream is of type t.
+func (c CacheConfig) HasUpstreamType(t UpstreamType) bool {
+	for _, upstream := range c.Upstreams {
+		if upstream.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Origins returns the upstream followed by each of its mirrors.
+func (u Upstream) Origins() []Upstream {
+	return append([]Upstream{u}, u.Mirrors...)
+}
+
+// Redacted returns a copy of the configuration with credentials removed, for
+// display.
+func (c CacheConfig) Redacted() CacheConfig {
+	upstreams := make([]Upstream, 0, len(c.Upstreams))
+	for _, upstream := range c.Upstreams {
+		upstream = upstream.redacted()
+		mirrors := make([]Upstream, 0, len(upstream.Mirrors))
+		for _, mirror := range upstream.Mirrors {
+			mirrors = append(mirrors, mirror.redacted())
+		}
+		upstream.Mirrors = mirrors
+		upstreams = append(upstreams, upstream)
+	}
+	c.Upstreams = upstreams
+	return c
+}
+
+func (u Upstream) redacted() Upstream {
+	if len(u.Authorization) > 0 {
+		u.Authorization = "<redacted>"
+	}
+	if len(u.ProxyAuthorization) > 0 {
+		u.ProxyAuthorization = "<redacted>"
+	}
+	// header values are often credentials
+	headers := make([]Header, 0, len(u.Headers))
+	for _, header := range u.Headers {
+		headers = append(headers, Header{Name: header.Name, Value: "<redacted>"})
+	}
+	u.Headers = headers
+	return u
 }
@@ -0,0 +1,263 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+// UpstreamSection is an upstream declared in a .upstream file. The section
+// name is the name of the upstream, and the TLS, authentication and proxy
+// keys have the same meaning as in a yum repository.
+type UpstreamSection struct {
+	Name string `ini:"-"`
+	Type string `ini:"type"`
+	URL  string `ini:"url"`
+	// FilesURL is the location of the package files linked from a Python
+	// package index.
+	FilesURL string `ini:"files_url"`
+	// SumDB is the location of the checksum database served by a Go module
+	// proxy, or "off", and SumDBName the name clients know it by.
+	SumDB     string `ini:"sumdb"`
+	SumDBName string `ini:"sumdb_name"`
+	// Members are the names of other upstreams in the same file that are
+	// combined, in order, into a Maven group instead of setting url.
+	Members []string `ini:"members" delim:" "`
+	// Cache lists cache rules, one per cache line, in the form accepted by
+	// ParseCacheRule. They are applied in order to the upstream named
+	// after the section.
+	Cache []string `ini:"-"`
+	// Labels are key=value pairs, separated by spaces, that frontends
+	// select upstreams by. They apply to every upstream the section
+	// declares.
+	Labels []string `ini:"labels" delim:" "`
+
+	SSLVerify     bool   `ini:"sslverify"`
+	SSLCACert     string `ini:"sslcacert"`
+	SSLClientKey  string `ini:"sslclientkey"`
+	SSLClientCert string `ini:"sslclientcert"`
+	Username      string `ini:"username"`
+	Password      string `ini:"password"`
+	Proxy         string `ini:"proxy"`
+	ProxyUsername string `ini:"proxy_username"`
+	ProxyPassword string `ini:"proxy_password"`
+}
+
+// LoadUpstreams loads the upstreams declared in iniFile.
+func LoadUpstreams(iniFile string, opts LoadOptions) ([]Upstream, error) {
+	// cache may be repeated
+	cfg, err := ini.ShadowLoad(iniFile)
+	if err != nil {
+		return nil, err
+	}
+	var defs []*UpstreamSection
+	byName := make(map[string]*UpstreamSection)
+	for _, section := range cfg.Sections() {
+		if section.Name() == ini.DEFAULT_SECTION {
+			continue
+		}
+		def := &UpstreamSection{
+			Name:      section.Name(),
+			SSLVerify: true,
+		}
+		if err := section.MapTo(def); err != nil {
+			return nil, &SectionError{Section: section.Name(), Err: err}
+		}
+		if section.HasKey("cache") {
+			def.Cache = section.Key("cache").ValueWithShadows()
+		}
+		defs = append(defs, def)
+		byName[def.Name] = def
+	}
+	var upstreams []Upstream
+	for _, def := range defs {
+		declared, err := def.upstreams(iniFile, byName, opts)
+		if err != nil {
+			return nil, &SectionError{Section: def.Name, Err: err}
+		}
+		var rules []CacheRule
+		for _, s := range def.Cache {
+			rule, err := ParseCacheRule(s)
+			if err != nil {
+				return nil, &SectionError{Section: def.Name, Err: fmt.Errorf("cache %q: %v", s, err)}
+			}
+			rules = append(rules, rule)
+		}
+		labels, err := ParseLabels(def.Labels)
+		if err != nil {
+			return nil, &SectionError{Section: def.Name, Err: err}
+		}
+		for i := range declared {
+			declared[i].Labels = labels
+		}
+		for i := range declared {
+			if declared[i].Name != def.Name {
+				continue
+			}
+			declared[i].CacheRules = rules
+			for j := range declared[i].Mirrors {
+				declared[i].Mirrors[j].CacheRules = rules
+			}
+		}
+		upstreams = append(upstreams, declared...)
+	}
+	return upstreams, nil
+}
+
+// upstreams converts the declaration into upstreams. Groups refer to the
+// other declarations in the file by name.
+func (s *UpstreamSection) upstreams(file string, byName map[string]*UpstreamSection, opts LoadOptions) ([]Upstream, error) {
+	switch UpstreamType(s.Type) {
+	case UpstreamTypePyPI:
+		index, err := s.origin(s.Name, s.URL, file, opts)
+		if err != nil {
+			return nil, err
+		}
+		filesURL := s.FilesURL
+		if len(filesURL) == 0 {
+			filesURL = "https://files.pythonhosted.org/"
+		}
+		files, err := s.origin(s.Name+"-files", filesURL, file, opts)
+		if err != nil {
+			return nil, err
+		}
+		// never send the credentials of the index to another server
+		if files.Hosts[0] != index.Hosts[0] {
+			files.Authorization = ""
+		}
+
+		index = chainOrigins(UpstreamTypePyPI, []Upstream{index})
+		index.Repo = true
+		index.Rewrites = []Rewrite{{From: files.Origin, To: files.Name}}
+		files = chainOrigins(UpstreamTypePyPIFiles, []Upstream{files})
+		return []Upstream{index, files}, nil
+	case UpstreamTypeGoProxy:
+		proxy, err := s.origin(s.Name, s.URL, file, opts)
+		if err != nil {
+			return nil, err
+		}
+		proxy = chainOrigins(UpstreamTypeGoProxy, []Upstream{proxy})
+		proxy.Repo = true
+		if s.SumDB == "off" {
+			return []Upstream{proxy}, nil
+		}
+		sumDBURL := s.SumDB
+		if len(sumDBURL) == 0 {
+			sumDBURL = "https://sum.golang.org/"
+		}
+		sumDB, err := s.origin(s.Name+"-sumdb", sumDBURL, file, opts)
+		if err != nil {
+			return nil, err
+		}
+		if sumDB.Hosts[0] != proxy.Hosts[0] {
+			sumDB.Authorization = ""
+		}
+		sumDBName := s.SumDBName
+		if len(sumDBName) == 0 {
+			u, _ := url.Parse(sumDB.Origin)
+			sumDBName = u.Hostname()
+		}
+		sumDB = chainOrigins(UpstreamTypeGoSumDB, []Upstream{sumDB})
+		sumDB.HealthPath = "latest"
+		// clients look for the checksum database of the proxy before
+		// contacting the database directly
+		proxy.Routes = []Route{{Path: "sumdb/" + sumDBName + "/", To: sumDB.Name}}
+		return []Upstream{proxy, sumDB}, nil
+	case UpstreamTypeRegistry:
+		// credentials are presented when the registry challenges the
+		// mirror, and are exchanged for a token if it uses bearer tokens
+		registry, err := s.origin(s.Name, s.URL, file, opts)
+		if err != nil {
+			return nil, err
+		}
+		registry = chainOrigins(UpstreamTypeRegistry, []Upstream{registry})
+		registry.Repo = true
+		return []Upstream{registry}, nil
+	case UpstreamTypeNPM:
+		registry, err := s.origin(s.Name, s.URL, file, opts)
+		if err != nil {
+			return nil, err
+		}
+		registry = chainOrigins(UpstreamTypeNPM, []Upstream{registry})
+		registry.Repo = true
+		registry.HealthPath = "-/ping"
+		// package metadata links to tarballs on the registry by absolute URL
+		registry.Rewrites = []Rewrite{{From: registry.Origin, To: registry.Name}}
+		return []Upstream{registry}, nil
+	case UpstreamTypeMaven:
+		if len(s.Members) == 0 {
+			repository, err := s.origin(s.Name, s.URL, file, opts)
+			if err != nil {
+				return nil, err
+			}
+			repository = chainOrigins(UpstreamTypeMaven, []Upstream{repository})
+			repository.Repo = true
+			return []Upstream{repository}, nil
+		}
+		if len(s.URL) > 0 {
+			return nil, fmt.Errorf("a group sets members instead of url")
+		}
+		// each member is tried in order until one has the content
+		var origins []Upstream
+		for i, name := range s.Members {
+			member, ok := byName[name]
+			if !ok || UpstreamType(member.Type) != UpstreamTypeMaven || len(member.Members) > 0 {
+				return nil, fmt.Errorf("member %s must be a maven repository declared in the same file", name)
+			}
+			origin, err := member.origin(mirrorName(s.Name, i), member.URL, file, opts)
+			if err != nil {
+				return nil, fmt.Errorf("member %s: %v", name, err)
+			}
+			origins = append(origins, origin)
+		}
+		group := chainOrigins(UpstreamTypeMaven, origins)
+		group.Repo = true
+		return []Upstream{group}, nil
+	case UpstreamTypeHelm:
+		repository, err := s.origin(s.Name, s.URL, file, opts)
+		if err != nil {
+			return nil, err
+		}
+		repository = chainOrigins(UpstreamTypeHelm, []Upstream{repository})
+		repository.Repo = true
+		return []Upstream{repository}, nil
+	case "":
+		return nil, fmt.Errorf("type is required")
+	default:
+		return nil, fmt.Errorf("unrecognized type %q", s.Type)
+	}
+}
+
+// origin returns an origin named name for the provided URL with the TLS,
+// authentication and proxy settings of the declaration.
+func (s *UpstreamSection) origin(name, rawURL, file string, opts LoadOptions) (Upstream, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if len(rawURL) == 0 {
+		return Upstream{}, fmt.Errorf("url is required")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return Upstream{}, fmt.Errorf("%s is not a valid http or https URL", rawURL)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	settings := originSettings{
+		SSLVerify:            s.SSLVerify,
+		CACertificatePath:    makePathRelativeToFile(file, s.SSLCACert),
+		ClientCertificate:    makePathRelativeToFile(file, s.SSLClientCert),
+		ClientCertificateKey: makePathRelativeToFile(file, s.SSLClientKey),
+		Username:             s.Username,
+		Password:             s.Password,
+		Proxy:                s.Proxy,
+		ProxyUsername:        s.ProxyUsername,
+		ProxyPassword:        s.ProxyPassword,
+	}
+	origin := newOrigin(name, u, opts)
+	if err := configureOrigin(&origin, settings, opts); err != nil {
+		return Upstream{}, err
+	}
+	return origin, nil
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Variables holds the values substituted for $name and ${name} references in
+// repository definitions, in the same way yum and dnf expand $releasever and
+// $basearch.
+type Variables map[string]string
+
+// DefaultVariables returns the built-in values for the variables yum and dnf
+// always define, derived from the current host.
+func DefaultVariables() Variables {
+	arch := BaseArch(runtime.GOARCH)
+	vars := Variables{
+		"arch":     arch,
+		"basearch": arch,
+		"infra":    "stock",
+	}
+	if version := osReleaseVersion("/etc/os-release"); len(version) > 0 {
+		vars["releasever"] = version
+	}
+	return vars
+}
+
+// BaseArch converts a Go architecture name to the name used by RPM
+// repositories. Unrecognized names are returned unchanged.
+func BaseArch(goarch string) string {
+	switch goarch {
+	case "amd64":
+		return "x86_64"
+	case "386":
+		return "i386"
+	case "arm64":
+		return "aarch64"
+	case "arm":
+		return "armhfp"
+	default:
+		return goarch
+	}
+}
+
+// ParseVariable parses a name=value pair.
+func ParseVariable(s string) (string, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return "", "", fmt.Errorf("variable %q must be of the form name=value", s)
+	}
+	return parts[0], parts[1], nil
+}
+
+// ResolveVariables returns the built-in defaults overlaid with the contents of
+// the provided dnf-style variable directories (one file per variable, the
+// first line being the value) and then with overrides. Directories listed
+// first take precedence, and directories that do not exist are ignored.
+func ResolveVariables(dirs []string, overrides Variables) (Variables, error) {
+	vars := DefaultVariables()
+	for i := len(dirs) - 1; i >= 0; i-- {
+		files, err := ioutil.ReadDir(dirs[i])
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, file := range files {
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(dirs[i], file.Name()))
+			if err != nil {
+				return nil, err
+			}
+			value := string(data)
+			if i := strings.Index(value, "\n"); i != -1 {
+				value = value[:i]
+			}
+			vars[file.Name()] = strings.TrimSpace(value)
+		}
+	}
+	for k, v := range overrides {
+		vars[k] = v
+	}
+	return vars, nil
+}
+
+// Expand replaces $name and ${name} references with their values. References
+// to undefined variables are left unchanged.
+func (v Variables) Expand(s string) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' {
+			buf = append(buf, s[i])
+			continue
+		}
+		start, end := i+1, i+1
+		braced := end < len(s) && s[end] == '{'
+		if braced {
+			start, end = end+1, end+1
+		}
+		for end < len(s) && isVariableChar(s[end]) {
+			end++
+		}
+		name := s[start:end]
+		if braced {
+			if end >= len(s) || s[end] != '}' {
+				buf = append(buf, s[i])
+				continue
+			}
+			end++
+		}
+		value, ok := v[name]
+		if len(name) == 0 || !ok {
+			buf = append(buf, s[i])
+			continue
+		}
+		buf = append(buf, value...)
+		i = end - 1
+	}
+	return string(buf)
+}
+
+func isVariableChar(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// References returns true if s refers to the named variable.
+func (v Variables) References(s, name string) bool {
+	return Variables{name: "\x00"}.Expand(s) != s
+}
+
+// With returns a copy of the variables with the provided value set.
+func (v Variables) With(name, value string) Variables {
+	copied := make(Variables, len(v)+1)
+	for k, v := range v {
+		copied[k] = v
+	}
+	copied[name] = value
+	return copied
+}
+
+// osReleaseVersion returns the VERSION_ID of the provided os-release file, or
+// an empty string if it cannot be determined.
+func osReleaseVersion(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "VERSION_ID=") {
+			continue
+		}
+		return strings.Trim(strings.TrimPrefix(line, "VERSION_ID="), `"'`)
+	}
+	return ""
+}
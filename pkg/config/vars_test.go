@@ -0,0 +1,56 @@
+package config
+
+import "testing"
+
+func TestVariablesExpand(t *testing.T) {
+	vars := Variables{
+		"releasever": "7",
+		"basearch":   "x86_64",
+		"empty":      "",
+	}
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "http://example.com/repo/", want: "http://example.com/repo/"},
+		{in: "http://example.com/$releasever/$basearch/", want: "http://example.com/7/x86_64/"},
+		{in: "http://example.com/${releasever}Server/", want: "http://example.com/7Server/"},
+		{in: "$releasever$basearch", want: "7x86_64"},
+		{in: "/$empty/", want: "//"},
+		// undefined and malformed references are left unchanged
+		{in: "/$undefined/$basearch/", want: "/$undefined/x86_64/"},
+		{in: "/${undefined}/", want: "/${undefined}/"},
+		{in: "/${releasever/", want: "/${releasever/"},
+		{in: "/${}/", want: "/${}/"},
+		{in: "/$/", want: "/$/"},
+		{in: "trailing$", want: "trailing$"},
+		{in: "$$basearch", want: "$x86_64"},
+		// a name ends at the first character that cannot be part of one
+		{in: "$releasever-server", want: "7-server"},
+		{in: "$releaseversion", want: "$releaseversion"},
+	}
+	for _, tt := range tests {
+		if got := vars.Expand(tt.in); got != tt.want {
+			t.Errorf("Expand(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestVariablesReferences(t *testing.T) {
+	tests := []struct {
+		in   string
+		name string
+		want bool
+	}{
+		{in: "http://example.com/$basearch/", name: "basearch", want: true},
+		{in: "http://example.com/${basearch}/", name: "basearch", want: true},
+		{in: "http://example.com/$basearchive/", name: "basearch", want: false},
+		{in: "http://example.com/$arch/", name: "basearch", want: false},
+		{in: "http://example.com/", name: "basearch", want: false},
+	}
+	for _, tt := range tests {
+		if got := (Variables{}).References(tt.in, tt.name); got != tt.want {
+			t.Errorf("References(%q, %q) = %t, want %t", tt.in, tt.name, got, tt.want)
+		}
+	}
+}
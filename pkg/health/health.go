@@ -0,0 +1,164 @@
+package health
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openshift/content-mirror/pkg/config"
+)
+
+// ConfigAccessor returns the last valid configuration.
+type ConfigAccessor interface {
+	LastConfig() *config.CacheConfig
+}
+
+// Status is the result of the most recent check of an origin.
+type Status struct {
+	Healthy bool
+	Checked time.Time
+	Message string
+}
+
+func (s Status) String() string {
+	switch {
+	case s.Checked.IsZero():
+		return "unknown"
+	case s.Healthy:
+		return "healthy"
+	default:
+		return fmt.Sprintf("unhealthy: %s", s.Message)
+	}
+}
+
+// Checker periodically requests each origin of the configured upstreams and
+// records whether it responded successfully.
+type Checker struct {
+	interval time.Duration
+	timeout  time.Duration
+
+	lock       sync.Mutex
+	statuses   map[string]Status
+	transports map[string]*http.Transport
+}
+
+// New creates a checker that checks every origin at interval.
+func New(interval, timeout time.Duration) *Checker {
+	return &Checker{
+		interval:   interval,
+		timeout:    timeout,
+		statuses:   make(map[string]Status),
+		transports: make(map[string]*http.Transport),
+	}
+}
+
+// Status returns the last known status of the provided origin URL.
+func (c *Checker) Status(origin string) Status {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.statuses[origin]
+}
+
+// Run checks the origins of the last valid configuration until the process
+// exits.
+func (c *Checker) Run(accessor ConfigAccessor) {
+	for {
+		cfg := accessor.LastConfig()
+		if cfg == nil {
+			time.Sleep(time.Second)
+			continue
+		}
+		c.checkAll(cfg.Upstreams)
+		time.Sleep(c.interval)
+	}
+}
+
+func (c *Checker) checkAll(upstreams []config.Upstream) {
+	statuses := make(map[string]Status)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	for _, upstream := range upstreams {
+		if len(upstream.HealthPath) == 0 {
+			continue
+		}
+		for _, origin := range upstream.Origins() {
+			if len(origin.Origin) == 0 {
+				continue
+			}
+			wg.Add(1)
+			go func(origin config.Upstream, path string) {
+				defer wg.Done()
+				status := c.check(origin, path)
+				lock.Lock()
+				defer lock.Unlock()
+				statuses[origin.Origin] = status
+			}(origin, upstream.HealthPath)
+		}
+	}
+	wg.Wait()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for origin, status := range statuses {
+		if previous, ok := c.statuses[origin]; ok && previous.Healthy != status.Healthy {
+			log.Printf("Mirror %s is %s", origin, status)
+		}
+	}
+	c.statuses = statuses
+}
+
+func (c *Checker) check(origin config.Upstream, path string) Status {
+	status := Status{Checked: time.Now()}
+	transport, err := c.transportFor(origin)
+	if err != nil {
+		status.Message = err.Error()
+		return status
+	}
+	client := &http.Client{Transport: transport, Timeout: c.timeout}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(origin.Origin, "/")+"/"+path, nil)
+	if err != nil {
+		status.Message = err.Error()
+		return status
+	}
+	if len(origin.Authorization) > 0 {
+		req.Header.Set("Authorization", origin.Authorization)
+	}
+	if len(origin.ProxyAuthorization) > 0 && !origin.TLS {
+		req.Header.Set("Proxy-Authorization", origin.ProxyAuthorization)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		status.Message = err.Error()
+		return status
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1024*1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		status.Message = resp.Status
+		return status
+	}
+	status.Healthy = true
+	return status
+}
+
+// transportFor returns a transport with the same TLS settings nginx uses to
+// contact origin.
+func (c *Checker) transportFor(origin config.Upstream) (*http.Transport, error) {
+	key := origin.TransportKey()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if transport, ok := c.transports[key]; ok {
+		return transport, nil
+	}
+	transport, err := origin.Transport()
+	if err != nil {
+		return nil, err
+	}
+	c.transports[key] = transport
+	return transport, nil
+}
@@ -0,0 +1,350 @@
+package helm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/openshift/content-mirror/pkg/config"
+)
+
+// ConfigAccessor returns the last valid configuration.
+type ConfigAccessor interface {
+	LastConfig() *config.CacheConfig
+}
+
+// URLFunc returns the URL clients use to reach upstream through the mirror.
+type URLFunc func(req *http.Request, upstream *config.Upstream) string
+
+// Handler serves the index of Helm chart repositories with every chart URL
+// rewritten to the mirror, and the charts the index links to on other hosts:
+//
+//	/_helm/<name>/index.yaml             the rewritten index
+//	/_helm/<name>/charts/<hash>/<file>   a chart hosted elsewhere
+type Handler struct {
+	accessor ConfigAccessor
+	urlFor   URLFunc
+	timeout  time.Duration
+	// maxAge is how long an index is used before it is retrieved again.
+	maxAge time.Duration
+
+	lock       sync.Mutex
+	indexes    map[string]*index
+	transports map[string]*http.Transport
+}
+
+// index is the last copy of the index retrieved from an origin.
+type index struct {
+	retrieved time.Time
+	data      []byte
+	// external maps the hash of chart URLs on other hosts to the URL.
+	external map[string]string
+	// rewritten caches the index rewritten for each mirror URL.
+	rewritten map[string][]byte
+}
+
+// maxRewritten bounds the copies of an index rewritten for different mirror
+// URLs, which depend on the Host header of the client.
+const maxRewritten = 16
+
+// New creates a handler for the Helm repositories in the configuration
+// returned by accessor.
+func New(accessor ConfigAccessor, urlFor URLFunc, timeout, maxAge time.Duration) *Handler {
+	return &Handler{
+		accessor:   accessor,
+		urlFor:     urlFor,
+		timeout:    timeout,
+		maxAge:     maxAge,
+		indexes:    make(map[string]*index),
+		transports: make(map[string]*http.Transport),
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/_helm/"), "/", 2)
+	if len(parts) != 2 {
+		http.NotFound(w, req)
+		return
+	}
+	upstream, ok := h.repository(parts[0])
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	switch {
+	case parts[1] == "index.yaml":
+		mirrorURL := h.urlFor(req, &upstream)
+		data, err := h.index(upstream, mirrorURL)
+		if err != nil {
+			log.Printf("error: unable to retrieve the index of %s: %v", upstream.Name, err)
+			http.Error(w, "unable to retrieve the repository index", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-yaml")
+		w.Write(data)
+	case strings.HasPrefix(parts[1], "charts/"):
+		h.chart(w, req, upstream, strings.TrimPrefix(parts[1], "charts/"))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (h *Handler) repository(name string) (config.Upstream, bool) {
+	cfg := h.accessor.LastConfig()
+	if cfg == nil {
+		return config.Upstream{}, false
+	}
+	for _, upstream := range cfg.Upstreams {
+		if upstream.Name == name && upstream.Type == config.UpstreamTypeHelm {
+			return upstream, true
+		}
+	}
+	return config.Upstream{}, false
+}
+
+// index returns the index of upstream rewritten to mirrorURL. The last copy
+// of the index is used if it cannot be retrieved.
+func (h *Handler) index(upstream config.Upstream, mirrorURL string) ([]byte, error) {
+	h.lock.Lock()
+	current, ok := h.indexes[upstream.Origin]
+	h.lock.Unlock()
+
+	if !ok || time.Since(current.retrieved) > h.maxAge {
+		data, err := h.retrieve(upstream)
+		switch {
+		case err == nil:
+			external, err := externalCharts(data, upstream.Origin)
+			if err != nil {
+				return nil, err
+			}
+			current = &index{
+				retrieved: time.Now(),
+				data:      data,
+				external:  external,
+				rewritten: make(map[string][]byte),
+			}
+			h.lock.Lock()
+			h.indexes[upstream.Origin] = current
+			h.lock.Unlock()
+		case ok:
+			log.Printf("warn: unable to refresh the index of %s, the last copy will be used: %v", upstream.Name, err)
+		default:
+			return nil, err
+		}
+	}
+
+	h.lock.Lock()
+	data, ok := current.rewritten[mirrorURL]
+	h.lock.Unlock()
+	if ok {
+		return data, nil
+	}
+	data, err := rewriteIndex(current.data, upstream.Origin, mirrorURL)
+	if err != nil {
+		return nil, err
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(current.rewritten) >= maxRewritten {
+		current.rewritten = make(map[string][]byte)
+	}
+	current.rewritten[mirrorURL] = data
+	return data, nil
+}
+
+func (h *Handler) retrieve(upstream config.Upstream) ([]byte, error) {
+	transport, err := h.transport(upstream, false)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: transport, Timeout: h.timeout}
+	req, err := http.NewRequest("GET", upstream.Origin+"index.yaml", nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(upstream.Authorization) > 0 {
+		req.Header.Set("Authorization", upstream.Authorization)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the repository responded with %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// chart writes a chart that the index of upstream links to on another host.
+// Only charts listed in the last copy of the index are served.
+func (h *Handler) chart(w http.ResponseWriter, req *http.Request, upstream config.Upstream, rest string) {
+	hash := strings.SplitN(rest, "/", 2)[0]
+	h.lock.Lock()
+	var chartURL string
+	if current, ok := h.indexes[upstream.Origin]; ok {
+		chartURL = current.external[hash]
+	}
+	h.lock.Unlock()
+	if len(chartURL) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+
+	transport, err := h.transport(upstream, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(chartURL)
+	if err != nil {
+		log.Printf("error: unable to retrieve chart %s for %s: %v", chartURL, upstream.Name, err)
+		http.Error(w, "unable to retrieve the chart", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for _, header := range []string{"Content-Type", "Content-Length", "ETag", "Last-Modified"} {
+		if value := resp.Header.Get(header); len(value) > 0 {
+			w.Header().Set(header, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// transport returns a shared transport for the origin of upstream, or for
+// other hosts if external is true.
+func (h *Handler) transport(upstream config.Upstream, external bool) (*http.Transport, error) {
+	key := fmt.Sprintf("%t\x00%s", external, upstream.TransportKey())
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if transport, ok := h.transports[key]; ok {
+		return transport, nil
+	}
+	var transport *http.Transport
+	var err error
+	if external {
+		transport, err = upstream.ProxyTransport()
+	} else {
+		transport, err = upstream.Transport()
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.transports[key] = transport
+	return transport, nil
+}
+
+// chartPath returns the path relative to the mirror URL of the repository
+// that serves chartURL. Charts under the origin keep their path and charts on
+// other hosts are served by the local server under _charts/, in which case
+// the absolute URL of the chart is also returned.
+func chartPath(origin, chartURL string) (string, string, error) {
+	base, err := url.Parse(origin)
+	if err != nil {
+		return "", "", err
+	}
+	u, err := base.Parse(chartURL)
+	if err != nil {
+		return "", "", fmt.Errorf("the chart URL %s is not valid: %v", chartURL, err)
+	}
+	abs := u.String()
+	if strings.HasPrefix(abs, origin) {
+		return strings.TrimPrefix(abs, origin), "", nil
+	}
+	return fmt.Sprintf("_charts/%s/%s", chartHash(abs), path.Base(u.Path)), abs, nil
+}
+
+// chartHash identifies a chart hosted outside of the repository.
+func chartHash(chartURL string) string {
+	sum := sha256.Sum256([]byte(chartURL))
+	return hex.EncodeToString(sum[:8])
+}
+
+// externalCharts returns the charts listed in the index that are hosted
+// outside of origin, by hash.
+func externalCharts(data []byte, origin string) (map[string]string, error) {
+	external := make(map[string]string)
+	err := walkChartURLs(data, func(chartURL string) (string, error) {
+		_, abs, err := chartPath(origin, chartURL)
+		if err != nil {
+			return "", err
+		}
+		if len(abs) > 0 {
+			external[chartHash(abs)] = abs
+		}
+		return chartURL, nil
+	}, nil)
+	return external, err
+}
+
+// rewriteIndex returns the index with each chart URL replaced with a URL
+// under mirrorURL.
+func rewriteIndex(data []byte, origin, mirrorURL string) ([]byte, error) {
+	var out yaml.MapSlice
+	err := walkChartURLs(data, func(chartURL string) (string, error) {
+		p, _, err := chartPath(origin, chartURL)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(mirrorURL, "/") + "/" + p, nil
+	}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(out)
+}
+
+// walkChartURLs invokes fn with every URL listed under entries.<chart>[].urls
+// and replaces the URL with the result. If out is set it receives the
+// modified index.
+func walkChartURLs(data []byte, fn func(string) (string, error), out *yaml.MapSlice) error {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("the index is not valid: %v", err)
+	}
+	for _, item := range doc {
+		if item.Key != "entries" {
+			continue
+		}
+		charts, _ := item.Value.(yaml.MapSlice)
+		for _, chart := range charts {
+			versions, _ := chart.Value.([]interface{})
+			for _, version := range versions {
+				fields, _ := version.(yaml.MapSlice)
+				for i := range fields {
+					if fields[i].Key != "urls" {
+						continue
+					}
+					urls, _ := fields[i].Value.([]interface{})
+					for j := range urls {
+						s, ok := urls[j].(string)
+						if !ok {
+							continue
+						}
+						rewritten, err := fn(s)
+						if err != nil {
+							return err
+						}
+						urls[j] = rewritten
+					}
+				}
+			}
+		}
+	}
+	if out != nil {
+		*out = doc
+	}
+	return nil
+}
@@ -2,29 +2,127 @@ package process
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/openshift/content-mirror/pkg/reaper"
 )
 
+// reloadGrace is how long nginx must keep running after it is signaled to
+// reload without logging an emergency before the configuration is
+// considered loaded.
+const reloadGrace = 2 * time.Second
+
 type Process struct {
-	path string
+	binary string
+	path   string
+	// args are passed to every invocation of nginx.
+	args []string
+	// loaded is invoked whenever nginx is started or has loaded the
+	// configuration after being signaled.
+	loaded func()
 
 	configAvailable chan struct{}
+
+	policy RestartPolicy
+
+	lock sync.Mutex
+	// cmd is the running nginx process, if any, and exited is closed when
+	// it exits.
+	cmd      *exec.Cmd
+	exited   chan struct{}
+	stopping bool
+	restarts []Restart
 }
 
 // New starts and manages a nginx child process that should be reloaded when
-// notified. It uses the provided config path and will not load until the first time Reload()
+// notified. It runs binary, or nginx from the PATH if binary is empty, with
+// the provided config path and will not load until the first time Reload()
 // is called.
-func New(configPath string) *Process {
+func New(binary, configPath string) *Process {
+	if len(binary) == 0 {
+		binary = "nginx"
+	}
 	return &Process{
+		binary:          binary,
 		path:            configPath,
 		configAvailable: make(chan struct{}, 1),
+		policy:          DefaultRestartPolicy,
+	}
+}
+
+// SetLoaded invokes fn whenever nginx is started or has loaded the
+// configuration after being signaled.
+func (w *Process) SetLoaded(fn func()) {
+	w.loaded = fn
+}
+
+// SetRestartPolicy controls how nginx is restarted when it exits. It must be
+// called before Run.
+func (w *Process) SetRestartPolicy(policy RestartPolicy) {
+	w.policy = policy
+}
+
+// Restarts returns the most recent unexpected exits of nginx, oldest first.
+func (w *Process) Restarts() []Restart {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]Restart{}, w.restarts...)
+}
+
+// SetArgs passes args to every invocation of nginx. It must be called before
+// Run.
+func (w *Process) SetArgs(args ...string) {
+	w.args = args
+}
+
+// Validate checks the configuration at path with nginx -t.
+func (w *Process) Validate(path string) error {
+	_, err := w.output("-c", path, "-t")
+	return err
+}
+
+// Version returns the output of nginx -V, which describes the version of
+// nginx and the modules it was built with.
+func (w *Process) Version() (string, error) {
+	return w.output("-V")
+}
+
+// output runs nginx with args and returns what it printed. If nginx fails the
+// output is returned as the error.
+func (w *Process) output(args ...string) (string, error) {
+	// the reaper waits for the command, so its output is read from a pipe
+	r, out, err := os.Pipe()
+	if err != nil {
+		return "", err
 	}
+	defer r.Close()
+	cmd := w.command(args...)
+	cmd.Stdout, cmd.Stderr = out, out
+	exited, err := reaper.StartCommand(cmd)
+	out.Close()
+	if err != nil {
+		return "", fmt.Errorf("unable to execute command: %v", err)
+	}
+	output, _ := ioutil.ReadAll(r)
+	if err := <-exited; err != nil {
+		if _, ok := err.(*reaper.ExitError); ok {
+			return "", fmt.Errorf("%s", strings.TrimSpace(string(output)))
+		}
+		return "", fmt.Errorf("unable to execute command: %v", err)
+	}
+	return string(output), nil
+}
+
+func (w *Process) command(args ...string) *exec.Cmd {
+	return exec.Command(w.binary, append(append([]string{}, w.args...), args...)...)
 }
 
 func (w *Process) Reload() {
@@ -35,50 +133,150 @@ func (w *Process) Reload() {
 }
 
 func (w *Process) Run() {
+	// the reaper must be running before any command is started
+	reaper.Start()
 	go func() {
-		reaper.Start()
-
-		// wait for the first configuration to be available
+		// wait for the first configuration to be available, which has
+		// already been validated
 		<-w.configAvailable
-		if out, err := exec.Command("nginx", "-c", w.path, "-t").CombinedOutput(); err != nil {
-			if _, ok := err.(*exec.ExitError); ok {
-				fmt.Fprintf(os.Stderr, "error: the generated configuration is not valid:\n%s", string(out))
-			} else {
-				fmt.Fprintf(os.Stderr, "error: unable to execute command: %v", err)
-			}
-			os.Exit(1)
-		}
 
 		log.Printf("Starting proxy ...")
-		exits := 0
+		// exits are the times nginx exited within the restart window
+		var exits []time.Time
 		for {
-			if err := w.runOnce(); err != nil {
-				log.Printf("error: %v", err)
-				time.Sleep(time.Second)
+			stderr := newTailWriter(10)
+			started := time.Now()
+			err := w.runOnce(stderr)
+			if w.isStopping() {
+				return
+			}
+			now := time.Now()
+			exits = append(exits, now)
+			for len(exits) > 0 && now.Sub(exits[0]) > w.policy.Window {
+				exits = exits[1:]
+			}
+			restart := Restart{
+				Time:    now,
+				Uptime:  now.Sub(started),
+				Err:     err,
+				Output:  stderr.Lines(),
+				Backoff: w.policy.backoff(len(exits)),
+			}
+			w.recordRestart(restart)
+
+			if err != nil {
+				log.Printf("error: Proxy process exited after %s: %v", restart.Uptime.Round(time.Millisecond), err)
 			} else {
-				log.Printf("warn: process exited without error")
+				log.Printf("warn: Proxy process exited without error after %s", restart.Uptime.Round(time.Millisecond))
 			}
-			exits++
-			if exits > 5 {
-				log.Printf("error: Proxy process has exited too many times, crashing")
+			if len(exits) > w.policy.MaxRestarts {
+				log.Printf("error: Proxy process has exited %d times in %s, crashing", len(exits), w.policy.Window)
 				os.Exit(1)
 			}
+			log.Printf("Restarting proxy in %s ...", restart.Backoff)
+			time.Sleep(restart.Backoff)
 		}
 	}()
 }
 
-func (w *Process) runOnce() error {
-	cmd := exec.Command("nginx", "-c", w.path)
+func (w *Process) recordRestart(restart Restart) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.restarts = append(w.restarts, restart)
+	if len(w.restarts) > maxRestartHistory {
+		w.restarts = w.restarts[len(w.restarts)-maxRestartHistory:]
+	}
+}
+
+// Signal sends sig to nginx if it is running.
+func (w *Process) Signal(sig os.Signal) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.cmd == nil {
+		return nil
+	}
+	return w.cmd.Process.Signal(sig)
+}
+
+// Stop prevents nginx from being restarted and asks it to exit once it has
+// finished serving current requests. If nginx has not exited within timeout
+// it is killed and an error is returned.
+func (w *Process) Stop(timeout time.Duration) error {
+	w.lock.Lock()
+	w.stopping = true
+	cmd, exited := w.cmd, w.exited
+	w.lock.Unlock()
+	if cmd == nil {
+		return nil
+	}
+
+	log.Printf("Stopping proxy ...")
+	if err := cmd.Process.Signal(syscall.SIGQUIT); err != nil {
+		return fmt.Errorf("unable to stop nginx: %v", err)
+	}
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		<-exited
+		return fmt.Errorf("nginx did not finish serving requests within %s and was killed", timeout)
+	}
+}
+
+func (w *Process) isStopping() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.stopping
+}
+
+// runOnce starts nginx and reloads it whenever the configuration changes
+// until it exits. The output nginx writes to stderr is also copied to stderr.
+func (w *Process) runOnce(stderr *tailWriter) error {
+	cmd := w.command("-c", w.path)
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Start(); err != nil {
+	// the reaper waits for the command, so stderr is copied from a pipe
+	r, out, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = out
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		defer r.Close()
+		io.Copy(io.MultiWriter(os.Stderr, stderr), r)
+	}()
+	exited := make(chan struct{})
+	w.lock.Lock()
+	if w.stopping {
+		w.lock.Unlock()
+		out.Close()
+		return nil
+	}
+	status, err := reaper.StartCommand(cmd)
+	out.Close()
+	if err != nil {
+		w.lock.Unlock()
 		return err
 	}
+	w.cmd, w.exited = cmd, exited
+	w.lock.Unlock()
+	w.notifyLoaded()
 
-	done := make(chan error)
+	done := make(chan error, 1)
 	go func() {
-		defer close(done)
-		done <- cmd.Wait()
+		err := <-status
+		// workers that outlive nginx may hold the pipe open
+		select {
+		case <-copied:
+		case <-time.After(time.Second):
+		}
+		w.lock.Lock()
+		w.cmd = nil
+		w.lock.Unlock()
+		close(exited)
+		done <- err
 	}()
 
 	for {
@@ -89,9 +287,32 @@ func (w *Process) runOnce() error {
 			if !ok {
 				return nil
 			}
+			emergencies := stderr.Emergencies()
 			if err := cmd.Process.Signal(syscall.SIGHUP); err != nil {
 				log.Printf("error: unable to signal command: %v", err)
+				continue
+			}
+			// the configuration has passed nginx -t, but the master can still
+			// fail to apply it, for instance when a port cannot be bound. It
+			// then logs an emergency and keeps the previous configuration, so
+			// the configuration is only considered loaded once the master has
+			// run for reloadGrace without doing so.
+			select {
+			case err := <-done:
+				return err
+			case <-time.After(reloadGrace):
+			}
+			if stderr.Emergencies() > emergencies {
+				log.Printf("error: nginx was unable to load the configuration, the previous configuration is still in use")
+				continue
 			}
+			w.notifyLoaded()
 		}
 	}
 }
+
+func (w *Process) notifyLoaded() {
+	if w.loaded != nil {
+		w.loaded()
+	}
+}
@@ -0,0 +1,124 @@
+package process
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RestartPolicy controls how nginx is restarted when it exits unexpectedly.
+type RestartPolicy struct {
+	// MaxRestarts is how many times nginx may exit within Window before the
+	// program exits.
+	MaxRestarts int
+	// Window is how long an exit counts against MaxRestarts.
+	Window time.Duration
+	// InitialBackoff is the delay before the first restart within Window,
+	// which doubles for each further restart up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRestartPolicy tolerates occasional crashes over a long lifetime but
+// gives up on an nginx that cannot stay up.
+var DefaultRestartPolicy = RestartPolicy{
+	MaxRestarts:    5,
+	Window:         5 * time.Minute,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+// backoff returns the delay before restarting after the given number of exits
+// within the window.
+func (p RestartPolicy) backoff(exits int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 1; i < exits && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
+
+// Restart records an unexpected exit of nginx.
+type Restart struct {
+	Time time.Time
+	// Uptime is how long nginx ran before it exited.
+	Uptime time.Duration
+	// Err is why nginx exited, or nil if it exited with status 0.
+	Err error
+	// Output is the last lines nginx wrote to stderr.
+	Output []string
+	// Backoff is how long the restart was delayed.
+	Backoff time.Duration
+}
+
+// maxRestartHistory is the number of restarts that are remembered.
+const maxRestartHistory = 20
+
+// tailWriter keeps the last lines written to it.
+type tailWriter struct {
+	lock    sync.Mutex
+	max     int
+	lines   []string
+	partial []byte
+	// emergencies counts the lines nginx logged at the emerg level.
+	emergencies int
+}
+
+func newTailWriter(max int) *tailWriter {
+	return &tailWriter{max: max}
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	data := append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			break
+		}
+		t.add(string(data[:i]))
+		data = data[i+1:]
+	}
+	t.partial = append([]byte{}, data...)
+	return len(p), nil
+}
+
+func (t *tailWriter) add(line string) {
+	line = strings.TrimRight(line, "\r")
+	if len(line) == 0 {
+		return
+	}
+	if strings.Contains(line, "[emerg]") {
+		t.emergencies++
+	}
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
+
+// Emergencies returns the number of complete lines logged at the emerg level.
+func (t *tailWriter) Emergencies() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.emergencies
+}
+
+// Lines returns the retained lines, including any unterminated final line.
+func (t *tailWriter) Lines() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	lines := append([]string{}, t.lines...)
+	if len(t.partial) > 0 {
+		lines = append(lines, string(t.partial))
+		if len(lines) > t.max {
+			lines = lines[len(lines)-t.max:]
+		}
+	}
+	return lines
+}
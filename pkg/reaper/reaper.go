@@ -1,31 +1,71 @@
-// +build linux
-
 package reaper
 
 import (
 	"os"
-	"os/signal"
-	"syscall"
+	"os/exec"
+	"sync"
+)
+
+var (
+	// lock is held while children are reaped, so a child that is started
+	// with the lock held is always registered before it can be reaped.
+	lock    sync.Mutex
+	running bool
+	// waiters receive the exit status of the children started by
+	// StartCommand, by pid.
+	waiters = make(map[int]waiter)
 )
 
-// Start starts a goroutine to reap processes if called from a process
-// that has pid 1.
-func Start() {
-	if os.Getpid() == 1 {
+type waiter struct {
+	process *os.Process
+	done    chan error
+}
+
+// ExitError is returned to the waiter of a command that did not exit
+// successfully.
+type ExitError struct {
+	// Description is how the command exited, such as "exit status 1".
+	Description string
+}
+
+func (e *ExitError) Error() string {
+	return e.Description
+}
+
+// StartCommand starts cmd and returns a channel that receives nil when it
+// exits successfully or an error, usually an *ExitError, when it does not.
+// Once Start has been called the reaper is the only waiter for children, so
+// the caller must not call cmd.Wait and cmd's Stdin, Stdout and Stderr must
+// be nil or an *os.File.
+func StartCommand(cmd *exec.Cmd) (<-chan error, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	if !running {
 		go func() {
-			sigs := make(chan os.Signal, 1)
-			signal.Notify(sigs, syscall.SIGCHLD)
-			for {
-				// Wait for a child to terminate
-				<-sigs
-				for {
-					// Reap processes
-					cpid, _ := syscall.Wait4(-1, nil, syscall.WNOHANG, nil)
-					if cpid < 1 {
-						break
-					}
-				}
+			err := cmd.Wait()
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				err = &ExitError{Description: exitErr.Error()}
 			}
+			done <- err
 		}()
+		return done, nil
+	}
+	waiters[cmd.Process.Pid] = waiter{process: cmd.Process, done: done}
+	return done, nil
+}
+
+// deliver hands the exit status of a reaped child to its waiter, if it has
+// one. It must be called with the lock held.
+func deliver(pid int, err error) {
+	if w, ok := waiters[pid]; ok {
+		delete(waiters, pid)
+		// the process has been waited for, but its resources are only
+		// released by Wait
+		w.process.Release()
+		w.done <- err
 	}
 }
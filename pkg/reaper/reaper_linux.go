@@ -0,0 +1,77 @@
+//go:build linux
+// +build linux
+
+package reaper
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// prSetChildSubreaper is the prctl option that makes orphaned descendants
+// children of the calling process instead of pid 1.
+const prSetChildSubreaper = 36
+
+// Start starts a goroutine that reaps every child of the process and hands
+// the exit status of commands started with StartCommand to their waiter. If
+// the process is not pid 1 it becomes a subreaper, so orphaned descendants are
+// reaped as well.
+func Start() {
+	lock.Lock()
+	defer lock.Unlock()
+	if running {
+		return
+	}
+	if os.Getpid() != 1 {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+			log.Printf("warn: unable to become a subreaper, orphaned processes will not be reaped: %v", errno)
+		}
+	}
+	running = true
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGCHLD)
+	go func() {
+		for {
+			// Wait for a child to terminate
+			<-sigs
+			reap()
+		}
+	}()
+	// children may have exited before the signal was registered
+	go reap()
+}
+
+// reap collects every child that has exited.
+func reap() {
+	lock.Lock()
+	defer lock.Unlock()
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if pid < 1 {
+			return
+		}
+		deliver(pid, exitError(status))
+	}
+}
+
+// exitError describes status in the same way as os.ProcessState.
+func exitError(status syscall.WaitStatus) error {
+	switch {
+	case status.Exited() && status.ExitStatus() == 0:
+		return nil
+	case status.Exited():
+		return &ExitError{Description: fmt.Sprintf("exit status %d", status.ExitStatus())}
+	case status.Signaled():
+		return &ExitError{Description: fmt.Sprintf("signal: %v", status.Signal())}
+	default:
+		return &ExitError{Description: fmt.Sprintf("exited with status %#x", uint32(status))}
+	}
+}
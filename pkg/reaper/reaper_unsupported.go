@@ -1,8 +1,10 @@
+//go:build !linux
 // +build !linux
 
 package reaper
 
-// Start has no effect on non-linux platforms.
+// Start has no effect on non-linux platforms, where StartCommand waits for
+// each command itself.
 // Support for other unices will be added.
 func Start() {
 }
@@ -0,0 +1,434 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openshift/content-mirror/pkg/config"
+)
+
+// ConfigAccessor returns the last valid configuration.
+type ConfigAccessor interface {
+	LastConfig() *config.CacheConfig
+}
+
+const (
+	// AuthorizationHeader is set on token responses to the Authorization
+	// nginx must send to the registry, if any.
+	AuthorizationHeader = "X-Registry-Authorization"
+	// OriginalURIHeader is the request URI nginx is authorizing.
+	OriginalURIHeader = "X-Original-URI"
+	// LocationHeader is the Location a registry redirected nginx to.
+	LocationHeader = "X-Registry-Location"
+
+	// challengeTTL is how long the challenge of a registry is cached. A
+	// registry may start to require authentication or move its token
+	// service.
+	challengeTTL = 5 * time.Minute
+)
+
+// Handler serves the requests nginx makes to authenticate to registry
+// upstreams and to follow registry redirects to blob storage:
+//
+//	/_registry/<name>/token     returns the Authorization for OriginalURIHeader
+//	/_registry/<name>/redirect  returns the content at LocationHeader
+type Handler struct {
+	accessor ConfigAccessor
+	timeout  time.Duration
+
+	lock       sync.Mutex
+	transports map[string]*http.Transport
+	challenges map[string]cachedChallenge
+	tokens     map[string]token
+}
+
+type cachedChallenge struct {
+	challenge *challenge
+	expires   time.Time
+}
+
+// challenge is how a registry asks clients to authenticate. A nil challenge
+// means the registry allows anonymous access.
+type challenge struct {
+	scheme string
+	params map[string]string
+}
+
+type token struct {
+	authorization string
+	expires       time.Time
+}
+
+// New creates a handler for the registries in the configuration returned by
+// accessor.
+func New(accessor ConfigAccessor, timeout time.Duration) *Handler {
+	return &Handler{
+		accessor:   accessor,
+		timeout:    timeout,
+		transports: make(map[string]*http.Transport),
+		challenges: make(map[string]cachedChallenge),
+		tokens:     make(map[string]token),
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/_registry/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, req)
+		return
+	}
+	upstream, ok := h.registry(parts[0])
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	switch parts[1] {
+	case "token":
+		authorization, err := h.authorization(upstream, req.Header.Get(OriginalURIHeader))
+		if err != nil {
+			// content that is already cached can still be served, requests
+			// that reach the registry fail with its own error
+			log.Printf("warn: unable to authenticate to registry %s: %v", upstream.Name, err)
+		}
+		if len(authorization) > 0 {
+			w.Header().Set(AuthorizationHeader, authorization)
+		}
+		w.WriteHeader(http.StatusOK)
+	case "redirect":
+		h.redirect(w, req, upstream)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (h *Handler) registry(name string) (config.Upstream, bool) {
+	cfg := h.accessor.LastConfig()
+	if cfg == nil {
+		return config.Upstream{}, false
+	}
+	for _, upstream := range cfg.Upstreams {
+		if upstream.Name == name && upstream.Type == config.UpstreamTypeRegistry {
+			return upstream, true
+		}
+	}
+	return config.Upstream{}, false
+}
+
+// authorization returns the Authorization header that grants pull access to
+// the repository in requestURI, or an empty string if the registry does not
+// require authentication.
+func (h *Handler) authorization(upstream config.Upstream, requestURI string) (string, error) {
+	c, err := h.challenge(upstream)
+	if err != nil || c == nil {
+		return "", err
+	}
+	switch c.scheme {
+	case "basic":
+		if len(upstream.Authorization) == 0 {
+			return "", fmt.Errorf("the registry requires credentials")
+		}
+		return upstream.Authorization, nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("the registry requested unsupported authentication %q", c.scheme)
+	}
+
+	var scope string
+	if repository := repositoryFor(upstream.Name, requestURI); len(repository) > 0 {
+		scope = fmt.Sprintf("repository:%s:pull", repository)
+	}
+	key := strings.Join([]string{upstream.Name, upstream.Origin, upstream.Authorization, c.params["realm"], scope}, "\x00")
+	h.lock.Lock()
+	t, ok := h.tokens[key]
+	h.lock.Unlock()
+	if ok && time.Now().Before(t.expires) {
+		return t.authorization, nil
+	}
+
+	t, err = h.requestToken(upstream, c, scope)
+	if err != nil {
+		return "", err
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	// tokens are requested for every repository that is pulled, so expired
+	// tokens are removed rather than replaced
+	now := time.Now()
+	for k, existing := range h.tokens {
+		if !now.Before(existing.expires) {
+			delete(h.tokens, k)
+		}
+	}
+	h.tokens[key] = t
+	return t.authorization, nil
+}
+
+// challenge returns the challenge of the registry to anonymous requests,
+// which is cached per origin for challengeTTL. If the challenge cannot be
+// retrieved again the expired challenge is used.
+func (h *Handler) challenge(upstream config.Upstream) (*challenge, error) {
+	h.lock.Lock()
+	cached, ok := h.challenges[upstream.Origin]
+	h.lock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.challenge, nil
+	}
+
+	c, err := h.requestChallenge(upstream)
+	if err != nil {
+		if ok {
+			log.Printf("warn: unable to check how to authenticate to registry %s, using the previous challenge: %v", upstream.Name, err)
+			return cached.challenge, nil
+		}
+		return nil, err
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.challenges[upstream.Origin] = cachedChallenge{challenge: c, expires: time.Now().Add(challengeTTL)}
+	return c, nil
+}
+
+// requestChallenge makes an anonymous request to the registry and returns
+// the challenge it responds with, or nil if it allows anonymous access.
+func (h *Handler) requestChallenge(upstream config.Upstream) (*challenge, error) {
+	client, err := h.client(upstream)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(strings.TrimSuffix(upstream.Origin, "/") + "/v2/")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil, nil
+	case http.StatusUnauthorized:
+		c := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+		if c == nil {
+			return nil, fmt.Errorf("the registry did not return a valid WWW-Authenticate challenge")
+		}
+		return c, nil
+	default:
+		return nil, fmt.Errorf("the registry responded with %s", resp.Status)
+	}
+}
+
+// requestToken retrieves a bearer token for scope from the realm of the
+// challenge, presenting the credentials of the upstream if it has any.
+func (h *Handler) requestToken(upstream config.Upstream, c *challenge, scope string) (token, error) {
+	realm, err := url.Parse(c.params["realm"])
+	if err != nil || (realm.Scheme != "http" && realm.Scheme != "https") {
+		return token{}, fmt.Errorf("the registry returned an invalid token realm")
+	}
+	query := realm.Query()
+	if service, ok := c.params["service"]; ok {
+		query.Set("service", service)
+	}
+	if len(scope) > 0 {
+		query.Set("scope", scope)
+	}
+	realm.RawQuery = query.Encode()
+
+	// the token service is usually on another host, so only the proxy
+	// settings of the upstream apply
+	transport, err := h.proxyTransport(upstream)
+	if err != nil {
+		return token{}, err
+	}
+	client := &http.Client{Transport: transport, Timeout: h.timeout}
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return token{}, err
+	}
+	if len(upstream.Authorization) > 0 {
+		req.Header.Set("Authorization", upstream.Authorization)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return token{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return token{}, fmt.Errorf("the token service responded with %s", resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&body); err != nil {
+		return token{}, fmt.Errorf("the token service returned an invalid response: %v", err)
+	}
+	value := body.Token
+	if len(value) == 0 {
+		value = body.AccessToken
+	}
+	if len(value) == 0 {
+		return token{}, fmt.Errorf("the token service did not return a token")
+	}
+	// tokens without an expiry are valid for 60 seconds, refresh shortly
+	// before they expire
+	lifetime := 60 * time.Second
+	if body.ExpiresIn > 0 {
+		lifetime = time.Duration(body.ExpiresIn) * time.Second
+	}
+	return token{
+		authorization: "Bearer " + value,
+		expires:       time.Now().Add(lifetime * 9 / 10),
+	}, nil
+}
+
+// redirect writes the content at the location the registry redirected to,
+// so that nginx can cache it under the original request.
+func (h *Handler) redirect(w http.ResponseWriter, req *http.Request, upstream config.Upstream) {
+	base, err := url.Parse(upstream.Origin)
+	if err != nil {
+		http.Error(w, "invalid registry", http.StatusBadGateway)
+		return
+	}
+	location, err := base.Parse(req.Header.Get(LocationHeader))
+	if err != nil || (location.Scheme != "http" && location.Scheme != "https") {
+		http.Error(w, "the registry returned an invalid redirect", http.StatusBadGateway)
+		return
+	}
+
+	// blob storage is usually on another host that is signed by a public CA,
+	// and the redirect carries its own authorization
+	transportFor := h.proxyTransport
+	if location.Host == base.Host {
+		transportFor = h.transport
+	}
+	transport, err := transportFor(upstream)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get(location.String())
+	if err != nil {
+		log.Printf("error: unable to follow redirect from registry %s: %v", upstream.Name, err)
+		http.Error(w, "unable to retrieve redirected content", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for _, header := range []string{"Content-Type", "Content-Length", "ETag", "Last-Modified"} {
+		if value := resp.Header.Get(header); len(value) > 0 {
+			w.Header().Set(header, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// client returns a client with the TLS and proxy settings of upstream.
+func (h *Handler) client(upstream config.Upstream) (*http.Client, error) {
+	transport, err := h.transport(upstream)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport, Timeout: h.timeout}, nil
+}
+
+func (h *Handler) transport(upstream config.Upstream) (*http.Transport, error) {
+	key := upstream.TransportKey()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if transport, ok := h.transports[key]; ok {
+		return transport, nil
+	}
+	transport, err := upstream.Transport()
+	if err != nil {
+		return nil, err
+	}
+	h.transports[key] = transport
+	return transport, nil
+}
+
+// proxyTransport returns a shared transport for hosts other than the registry.
+func (h *Handler) proxyTransport(upstream config.Upstream) (*http.Transport, error) {
+	key := strings.Join([]string{"proxy", upstream.Proxy, upstream.ProxyAuthorization}, "\x00")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if transport, ok := h.transports[key]; ok {
+		return transport, nil
+	}
+	transport, err := upstream.ProxyTransport()
+	if err != nil {
+		return nil, err
+	}
+	h.transports[key] = transport
+	return transport, nil
+}
+
+// repositoryFor returns the repository a request for /v2/<name>/... refers
+// to, or an empty string if it does not refer to one.
+func repositoryFor(name, requestURI string) string {
+	path := requestURI
+	if i := strings.IndexAny(path, "?#"); i != -1 {
+		path = path[:i]
+	}
+	path = strings.TrimPrefix(path, "/v2/"+name+"/")
+	for _, segment := range []string{"/manifests/", "/blobs/", "/tags/"} {
+		if i := strings.LastIndex(path, segment); i > 0 {
+			return path[:i]
+		}
+	}
+	return ""
+}
+
+// parseChallenge parses a WWW-Authenticate header of the form
+// scheme key="value",key=value. It returns nil if the header is empty.
+func parseChallenge(header string) *challenge {
+	header = strings.TrimSpace(header)
+	if len(header) == 0 {
+		return nil
+	}
+	parts := strings.SplitN(header, " ", 2)
+	c := &challenge{scheme: strings.ToLower(parts[0]), params: make(map[string]string)}
+	if len(parts) == 1 {
+		return c
+	}
+	s := parts[1]
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		i := strings.Index(s, "=")
+		if i == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = s[i+1:]
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end], s[end+1:]
+			}
+			value = strings.Replace(value, `\"`, `"`, -1)
+		} else {
+			end := strings.Index(s, ",")
+			if end == -1 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		c.params[key] = value
+	}
+	return c
+}
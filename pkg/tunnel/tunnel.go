@@ -0,0 +1,299 @@
+package tunnel
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/openshift/content-mirror/pkg/config"
+)
+
+// ConfigAccessor returns the configuration that is about to be applied.
+type ConfigAccessor interface {
+	LoadedConfig() *config.CacheConfig
+}
+
+// Tunnel forwards connections accepted on a unix socket to a target host
+// through an HTTP proxy using CONNECT, or forwards the requests received on
+// them to the proxy if the target is not reached over TLS.
+type Tunnel struct {
+	// Path is the unix socket nginx connects to.
+	Path string
+	// Target is the host:port to connect to.
+	Target string
+	// HTTP is set if the target serves plain HTTP. Proxies usually only allow
+	// CONNECT to the HTTPS port, so requests are sent to the proxy with an
+	// absolute URI instead.
+	HTTP bool
+	// Proxy is the URL of the proxy, without credentials.
+	Proxy string
+	// ProxyAuthorization is sent to the proxy if set.
+	ProxyAuthorization string
+}
+
+// Manager keeps a listener open for every tunnel in the last valid
+// configuration.
+type Manager struct {
+	accessor ConfigAccessor
+
+	lock      sync.Mutex
+	listeners map[string]*listener
+}
+
+type listener struct {
+	tunnel   Tunnel
+	listener net.Listener
+}
+
+// New creates a manager for the tunnels required by the configuration
+// returned by accessor.
+func New(accessor ConfigAccessor) *Manager {
+	return &Manager{
+		accessor:  accessor,
+		listeners: make(map[string]*listener),
+	}
+}
+
+// Reload opens and closes listeners to match the configuration that is about
+// to be applied, before nginx loads it.
+func (m *Manager) Reload() {
+	cfg := m.accessor.LoadedConfig()
+	if cfg == nil {
+		return
+	}
+	var tunnels []Tunnel
+	for _, upstream := range cfg.Upstreams {
+		for _, origin := range upstream.Origins() {
+			if len(origin.Tunnel) == 0 {
+				continue
+			}
+			target := origin.Hosts[0]
+			if _, _, err := net.SplitHostPort(target); err != nil {
+				if origin.TLS {
+					target = net.JoinHostPort(target, "443")
+				} else {
+					target = net.JoinHostPort(target, "80")
+				}
+			}
+			tunnels = append(tunnels, Tunnel{
+				Path:               origin.Tunnel,
+				Target:             target,
+				HTTP:               !origin.TLS,
+				Proxy:              origin.Proxy,
+				ProxyAuthorization: origin.ProxyAuthorization,
+			})
+		}
+	}
+	if err := m.Sync(tunnels); err != nil {
+		log.Printf("error: unable to open tunnels: %v", err)
+	}
+}
+
+// Sync ensures exactly the provided tunnels are being served.
+func (m *Manager) Sync(tunnels []Tunnel) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	desired := make(map[string]Tunnel)
+	for _, t := range tunnels {
+		desired[t.Path] = t
+	}
+	for path, l := range m.listeners {
+		if t, ok := desired[path]; ok && t == l.tunnel {
+			continue
+		}
+		l.listener.Close()
+		delete(m.listeners, path)
+	}
+
+	var errs []error
+	for path, t := range desired {
+		if _, ok := m.listeners[path]; ok {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		os.Remove(path)
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		m.listeners[path] = &listener{tunnel: t, listener: l}
+		if t.HTTP {
+			go serveHTTP(l, t)
+		} else {
+			go serve(l, t)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
+
+func serve(l net.Listener, t Tunnel) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			remote, err := Dial(t)
+			if err != nil {
+				log.Printf("error: unable to connect to %s via %s: %v", t.Target, t.Proxy, err)
+				return
+			}
+			defer remote.Close()
+			done := make(chan struct{}, 2)
+			go func() {
+				io.Copy(remote, conn)
+				done <- struct{}{}
+			}()
+			go func() {
+				io.Copy(conn, remote)
+				done <- struct{}{}
+			}()
+			<-done
+		}()
+	}
+}
+
+// serveHTTP forwards the requests received on each connection accepted on l
+// to the proxy of t.
+func serveHTTP(l net.Listener, t Tunnel) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if err := forward(conn, t); err != nil {
+				log.Printf("error: unable to forward requests to %s via %s: %v", t.Target, t.Proxy, err)
+			}
+		}()
+	}
+}
+
+// forward reads requests from conn and sends them to the proxy of t with an
+// absolute URI, writing each response back to conn, until either side closes
+// the connection.
+func forward(conn net.Conn, t Tunnel) error {
+	remote, err := dialProxy(t)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+	requests, responses := bufio.NewReader(conn), bufio.NewReader(remote)
+	for {
+		req, err := http.ReadRequest(requests)
+		if err != nil {
+			// the client closed the connection
+			return nil
+		}
+		req.URL.Scheme = "http"
+		req.URL.Host = t.Target
+		if len(t.ProxyAuthorization) > 0 {
+			req.Header.Set("Proxy-Authorization", t.ProxyAuthorization)
+		}
+		if err := req.WriteProxy(remote); err != nil {
+			return err
+		}
+		resp, err := http.ReadResponse(responses, req)
+		if err != nil {
+			return err
+		}
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil || req.Close || resp.Close {
+			return err
+		}
+	}
+}
+
+// Dial opens a connection to the target of the tunnel through its proxy.
+func Dial(t Tunnel) (net.Conn, error) {
+	conn, err := dialProxy(t)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: t.Target},
+		Host:   t.Target,
+		Header: make(http.Header),
+	}
+	if len(t.ProxyAuthorization) > 0 {
+		req.Header.Set("Proxy-Authorization", t.ProxyAuthorization)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy responded with %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: br}, nil
+	}
+	return conn, nil
+}
+
+// dialProxy opens a connection to the proxy of the tunnel.
+func dialProxy(t Tunnel) (net.Conn, error) {
+	proxyURL, err := url.Parse(t.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	host := proxyURL.Host
+	if len(proxyURL.Port()) == 0 {
+		switch proxyURL.Scheme {
+		case "https":
+			host = net.JoinHostPort(proxyURL.Hostname(), "443")
+		default:
+			host = net.JoinHostPort(proxyURL.Hostname(), "80")
+		}
+	}
+	conn, err := net.DialTimeout("tcp", host, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+	}
+	return conn, nil
+}
+
+// bufferedConn returns data the proxy sent after its response before reading
+// from the connection.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -14,6 +14,7 @@ type Path struct {
 
 	changed  chan struct{}
 	trigger  chan struct{}
+	stop     chan struct{}
 	delay    time.Duration
 	maxDelay int
 }
@@ -27,6 +28,7 @@ func New(paths []string, fn func(paths []string) error) *Path {
 		onChanged: fn,
 		changed:   make(chan struct{}, 1),
 		trigger:   make(chan struct{}, 1),
+		stop:      make(chan struct{}),
 	}
 }
 
@@ -41,6 +43,20 @@ func (w *Path) SetMaxDelays(max int) {
 	w.maxDelay = max
 }
 
+// Trigger invokes the registered function as if the paths had changed. It
+// does nothing if an invocation is already pending.
+func (w *Path) Trigger() {
+	select {
+	case w.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Stop causes Run to return without an error. It may only be called once.
+func (w *Path) Stop() {
+	close(w.stop)
+}
+
 func (w *Path) changeCollapser() {
 	for {
 		select {
@@ -69,7 +85,7 @@ func (w *Path) changeCollapser() {
 
 // Run starts the content watcher. The registered function will always be
 // invoked at least once. Run exits when the registered function returns an
-// error or a filesystem error occurs.
+// error, a filesystem error occurs, or Stop is called.
 func (w *Path) Run() error {
 	fsw, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -85,9 +101,9 @@ func (w *Path) Run() error {
 	go func() {
 		// we always trigger on startup, before we get our first event
 		w.trigger <- struct{}{}
+		defer close(fsDone)
+		defer close(w.changed)
 		for {
-			defer close(fsDone)
-			defer close(w.changed)
 			select {
 			case err, ok := <-fsw.Errors:
 				if !ok {
@@ -139,5 +155,7 @@ func (w *Path) Run() error {
 		return err
 	case err := <-fnDone:
 		return err
+	case <-w.stop:
+		return nil
 	}
 }